@@ -3,9 +3,19 @@ package main
 import "os"
 
 type fetcher struct {
+	path     string
 	fileInfo os.FileInfo
+	// target is the key pointed to by a symlink file
+	target string
 }
 
 func (m *fetcher) Fetch(key string) string {
+	switch key {
+	case ETAGKEY:
+		tag, _ := etag(m.path)
+		return tag
+	case SYMLINKTARGETKEY:
+		return m.target
+	}
 	return ""
 }
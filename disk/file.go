@@ -1,13 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 
 	. "github.com/ctripcorp/nephele/storage"
 )
 
+// reserved keys of KV used by StoreFile for conditional writes.
+// IFNONEMATCHKEY with value "*" stores the file only if it is absent.
+const IFMATCHKEY = "If-Match"
+const IFNONEMATCHKEY = "If-None-Match"
+
+// ETAGKEY fetches the hash of the stored content from Meta.
+const ETAGKEY = "ETag"
+
+// SYMLINKTARGETKEY fetches the target key of a symlink file from Meta.
+const SYMLINKTARGETKEY = "X-Oss-Symlink-Target"
+
+// ErrOutsideRoot occurs when a symlink points out of the root dir of the storage.
+var ErrOutsideRoot = errors.New("symlink target is outside of the root")
+
+// ErrNotFound matches the errors of missing files by errors.Is,
+// which are the *os.PathError of the os calls and match it already.
+var ErrNotFound = os.ErrNotExist
+
+// ErrPreconditionFailed occurs when a conditional write does not match the stored file.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrPositionNotEqualToLength occurs when the index to append is not the size of the file.
+var ErrPositionNotEqualToLength = errors.New("position is not equal to file length")
+
 type file struct {
 	dir  string
 	key  string
@@ -40,28 +71,216 @@ func (f *file) Meta() (Fetcher, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &fetcher{fileInfo: fileInfo}, nil
+	m := &fetcher{path: f.Key(), fileInfo: fileInfo}
+	if symlink, _ := f.IsSymlink(); symlink {
+		if m.target, err = f.Target(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
+// Append appends blob to the file at index and returns the next index to append,
+// index must be the current size of the file and is 0 to create it.
 func (f *file) Append(blob []byte, index int64, kvs ...KV) (int64, string, error) {
+	unlock, err := lockDir(filepath.Dir(f.Key()))
+	if err != nil {
+		return 0, "", err
+	}
+	defer unlock()
 	fd, err := os.OpenFile(f.Key(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
 	if err != nil {
 		return 0, "", err
 	}
 	defer fd.Close()
-	off, err := fd.WriteAt(blob, index)
-	return int64(off), "", err
+	fileInfo, err := fd.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	if fileInfo.Size() != index {
+		return fileInfo.Size(), "", ErrPositionNotEqualToLength
+	}
+	n, err := fd.Write(blob)
+	return index + int64(n), "", err
 }
 
 func (f *file) Delete() (string, error) {
 	return "", os.Remove(f.Key())
 }
 
+// Bytes reads the file at the end of its whole chain of symlinks,
+// ErrOutsideRoot is returned if it ends out of the root dir.
 func (f *file) Bytes() ([]byte, string, error) {
-	bts, err := ioutil.ReadFile(f.Key())
+	path, err := resolve(f.dir, f.Key())
+	if err != nil {
+		return nil, "", err
+	}
+	bts, err := ioutil.ReadFile(path)
 	return bts, "", err
 }
 
 func (f *file) SetMeta(kvs ...KV) error {
 	return nil
 }
+
+// IsSymlink reports whether the file is a symlink created by Storage.Symlink.
+func (f *file) IsSymlink() (bool, error) {
+	fileInfo, err := os.Lstat(f.Key())
+	if err != nil {
+		return false, err
+	}
+	return fileInfo.Mode()&os.ModeSymlink != 0, nil
+}
+
+// Target returns the key which the symlink file points to,
+// ErrOutsideRoot is returned if the link escapes the root dir.
+func (f *file) Target() (string, error) {
+	link, err := os.Readlink(f.Key())
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(f.Key()), link)
+	}
+	return keyOf(f.dir, link)
+}
+
+// keyOf returns the key of path under the root dir, ErrOutsideRoot if path is not below it.
+func keyOf(dir, path string) (string, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return "", err
+	}
+	key, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+	if key == "." || key == ".." || strings.HasPrefix(key, ".."+string(filepath.Separator)) {
+		return "", ErrOutsideRoot
+	}
+	return key, nil
+}
+
+// resolve follows every symlink of path and checks that the result is still under the root dir,
+// whose own symlinks are followed as well.
+func resolve(dir, path string) (string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", err
+	}
+	if _, err = keyOf(root, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// store replaces the content of the file with blob, the conditional keys in kvs
+// are checked against the stored file first. The content is written to a temp file
+// renamed into place with the dir locked, so that readers never see a partial file
+// and no other writer changes the file between the check and the rename.
+func (f *file) store(blob []byte, kvs ...KV) error {
+	dir := filepath.Dir(f.Key())
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, kv := range kvs {
+		switch kv[0] {
+		case IFNONEMATCHKEY:
+			if kv[1] == "*" {
+				if _, err := os.Lstat(f.Key()); err == nil {
+					return ErrPreconditionFailed
+				} else if !os.IsNotExist(err) {
+					return err
+				}
+				continue
+			}
+			tag, err := etag(f.Key())
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err == nil && sameETag(tag, kv[1]) {
+				return ErrPreconditionFailed
+			}
+		case IFMATCHKEY:
+			tag, err := etag(f.Key())
+			if os.IsNotExist(err) {
+				return ErrPreconditionFailed
+			}
+			if err != nil {
+				return err
+			}
+			if !sameETag(tag, kv[1]) {
+				return ErrPreconditionFailed
+			}
+		}
+	}
+	return writeFile(f.Key(), bytes.NewReader(blob))
+}
+
+// writeFile writes the content of r to a temp file beside path and renames it onto path,
+// the caller holds the lock of the dir.
+func writeFile(path string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, r); err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// tempSuffix ends the names of the temp files written by writeFile, which are
+// dot-prefixed as well and skipped by the iterator.
+const tempSuffix = ".tmp"
+
+// isTemp reports whether name is a temp file of writeFile.
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempSuffix)
+}
+
+// lockDir takes an exclusive flock on dir, which is shared by the processes
+// writing the same root. The returned func releases it.
+func lockDir(dir string) (func(), error) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(fd.Fd()), syscall.LOCK_UN)
+		fd.Close()
+	}, nil
+}
+
+// etag returns the md5 of the file in the same form as oss does.
+func etag(path string) (string, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum(bts)
+	return "\"" + strings.ToUpper(hex.EncodeToString(sum[:])) + "\"", nil
+}
+
+func sameETag(a, b string) bool {
+	return strings.EqualFold(strings.Trim(a, "\""), strings.Trim(b, "\""))
+}
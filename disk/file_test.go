@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"testing"
+
+	. "github.com/ctripcorp/nephele/storage"
 )
 
 func Test_File(t *testing.T) {
@@ -17,11 +21,20 @@ func Test_File(t *testing.T) {
 		return
 	}
 	//2. append
-	_, _, e = f.Append(blob, 0)
+	next, _, e := f.Append(blob, int64(len(blob)))
 	if e != nil {
 		t.Error(e)
 		return
 	}
+	if next != int64(2*len(blob)) {
+		t.Error("next index invalid. next:", next)
+		return
+	}
+	//a stale writer appends at a wrong position
+	if next, _, e = f.Append(blob, int64(len(blob))); e != ErrPositionNotEqualToLength || next != int64(2*len(blob)) {
+		t.Error("append at wrong position should fail.", next, e)
+		return
+	}
 	//3. get file
 	bts, _, e := f.Bytes()
 	if e != nil {
@@ -39,6 +52,29 @@ func Test_File(t *testing.T) {
 		t.Error(e)
 		return
 	}
+	//6. get deleted file
+	if _, _, e = f.Bytes(); !errors.Is(e, ErrNotFound) {
+		t.Error("deleted file should be not found. e:", e)
+		return
+	}
+}
+
+func Test_KeyOf(t *testing.T) {
+	for _, c := range []struct {
+		dir, path, key string
+		err            error
+	}{
+		{"/", "/a/1.txt", "a/1.txt", nil},
+		{".", "a/1.txt", "a/1.txt", nil},
+		{"/root/", "/root/a/../1.txt", "1.txt", nil},
+		{"/root", "/rootless/1.txt", "", ErrOutsideRoot},
+		{"/root", "/root", "", ErrOutsideRoot},
+		{".", "../1.txt", "", ErrOutsideRoot},
+	} {
+		if key, e := keyOf(c.dir, c.path); key != c.key || e != c.err {
+			t.Error("keyOf invalid. dir:", c.dir, "path:", c.path, "key:", key, "e:", e)
+		}
+	}
 }
 
 func getCurrentPath() string {
@@ -47,3 +83,68 @@ func getCurrentPath() string {
 	path := string(s[0 : i+1])
 	return path
 }
+
+func Test_StoreFile(t *testing.T) {
+	s := &storage{dir: getCurrentPath()}
+	blob := []byte("testest")
+	//1. create only if absent
+	if _, e := s.StoreFile("2.txt", blob, KV{IFNONEMATCHKEY, "*"}); e != nil {
+		t.Error(e)
+		return
+	}
+	defer s.File("2.txt").Delete()
+	if _, e := s.StoreFile("2.txt", blob, KV{IFNONEMATCHKEY, "*"}); e != ErrPreconditionFailed {
+		t.Error("create twice should fail. e:", e)
+		return
+	}
+	//2. replace only if etag matches
+	m, e := s.File("2.txt").Meta()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	tag := m.Fetch(ETAGKEY)
+	if _, e = s.StoreFile("2.txt", []byte("test"), KV{IFMATCHKEY, tag}); e != nil {
+		t.Error(e)
+		return
+	}
+	if _, e = s.StoreFile("2.txt", blob, KV{IFMATCHKEY, tag}); e != ErrPreconditionFailed {
+		t.Error("stale etag should fail. e:", e)
+		return
+	}
+	bts, _, e := s.File("2.txt").Bytes()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if string(bts) != "test" {
+		t.Error("get content invalid.")
+		return
+	}
+	//3. only one of the writers matching the same etag wins
+	m, e = s.File("2.txt").Meta()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	tag = m.Fetch(ETAGKEY)
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			_, e := s.StoreFile("2.txt", []byte(strconv.Itoa(i)), KV{IFMATCHKEY, tag})
+			errs <- e
+		}(i)
+	}
+	won := 0
+	for i := 0; i < cap(errs); i++ {
+		if e := <-errs; e == nil {
+			won++
+		} else if e != ErrPreconditionFailed {
+			t.Error(e)
+			return
+		}
+	}
+	if won != 1 {
+		t.Error("conditional writers won:", won)
+	}
+}
@@ -67,7 +67,7 @@ func getNextFile(root, key string) (os.FileInfo, string, error) {
 			if fi != nil {
 				return fi, childDir, nil
 			}
-		} else {
+		} else if !isTemp(name) {
 			return f, dir, nil
 		}
 	}
@@ -102,6 +102,9 @@ func getChildFile(dir string) (os.FileInfo, string, error) {
 	}
 	for _, f := range fs {
 		if !f.IsDir() {
+			if isTemp(f.Name()) {
+				continue
+			}
 			return f, dir, nil
 		}
 		fi, childDir, err := getChildFile(join(dir, f.Name()+"/"))
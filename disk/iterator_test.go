@@ -1,5 +1,32 @@
 package main
 
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Iterator(t *testing.T) {
+	s := &storage{dir: t.TempDir()}
+	//a temp file left by an interrupted store is not a key
+	if e := ioutil.WriteFile(filepath.Join(s.dir, ".1.txt.123"+tempSuffix), []byte("1"), 0644); e != nil {
+		t.Error(e)
+		return
+	}
+	if _, e := s.StoreFile("1.txt", []byte("1")); e != nil {
+		t.Error(e)
+		return
+	}
+	f, e := s.Iterator("", "").Next()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if f.Key() != join(s.dir, "1.txt") {
+		t.Error("temp file should be skipped. key:", f.Key())
+	}
+}
+
 // func Test_getRealPath(t *testing.T) {
 // 	p, err := getRealPath("/home/gct/a.jpg")
 // 	if err != nil {
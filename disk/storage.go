@@ -1,6 +1,17 @@
 package main
 
-import . "github.com/ctripcorp/nephele/storage"
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	. "github.com/ctripcorp/nephele/storage"
+)
+
+// deleteWorkers bounds the number of files deleted at the same time by BatchDelete.
+const deleteWorkers = 16
 
 type storage struct {
 	dir string
@@ -21,7 +32,97 @@ func (s *storage) Iterator(prefix string, lastKey string) Iterator {
 }
 
 func (s *storage) StoreFile(key string, blob []byte, kvs ...KV) (string, error) {
-	f := s.File(key)
-	_, k, err := f.Append(blob, 0, kvs...)
-	return k, err
+	f := &file{dir: s.dir, key: key}
+	return "", f.store(blob, kvs...)
+}
+
+// Copy copies the content of src to dst. The bytes are copied instead of
+// hard linked, so that appending to one file never changes the other.
+// The copy is written as store does, readers of dst never see a partial file.
+// Copying a file onto itself changes nothing. Disk files carry no meta, kvs are ignored.
+func (s *storage) Copy(src, dst string, kvs ...KV) (string, error) {
+	from, to := join(s.dir, src), join(s.dir, dst)
+	r, err := os.Open(from)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	if filepath.Clean(from) == filepath.Clean(to) {
+		return "", nil
+	}
+	dir := filepath.Dir(to)
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	return "", writeFile(to, r)
+}
+
+// Rename moves src to dst.
+func (s *storage) Rename(src, dst string, kvs ...KV) (string, error) {
+	to := join(s.dir, dst)
+	if err := os.MkdirAll(path.Dir(to), 0777); err != nil {
+		return "", err
+	}
+	return "", os.Rename(join(s.dir, src), to)
+}
+
+// Symlink creates key as an alias of target, reading key returns the content of target.
+// The link is relative, so that the root dir can be moved as a whole.
+func (s *storage) Symlink(key, target string) (string, error) {
+	link, to := join(s.dir, key), join(s.dir, target)
+	if _, err := keyOf(s.dir, to); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(path.Dir(link), 0777); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(path.Dir(link), to)
+	if err != nil {
+		return "", err
+	}
+	return "", os.Symlink(rel, link)
+}
+
+// BatchDelete deletes keys by a pool of deleteWorkers.
+// The returned errors are indexed as keys, nil for the deleted ones. A missing key
+// is nil as well, the same as oss and fdfs, so that a retried batch does not fail
+// on the keys deleted by the last try.
+func (s *storage) BatchDelete(keys []string) []error {
+	return batch(keys, deleteWorkers, func(key string) error {
+		_, err := s.File(key).Delete()
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// batch runs do on keys by at most workers goroutines and returns when all are done.
+// do is called once for each key and errs[i] is its result on keys[i], so do only needs
+// to be safe for concurrent use. The fdfs plugin keeps a copy of it since every plugin
+// is a main package of its own.
+func batch(keys []string, workers int, do func(key string) error) []error {
+	errs := make([]error, len(keys))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(keys); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = do(keys[i])
+			}
+		}()
+	}
+	for i := range keys {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func Test_CopyRename(t *testing.T) {
+	s := &storage{dir: getCurrentPath()}
+	blob := []byte("testest")
+	if _, e := s.StoreFile("3.txt", blob); e != nil {
+		t.Error(e)
+		return
+	}
+	//1. copy into a new dir
+	if _, e := s.Copy("3.txt", "copy/3.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	//copying a file onto itself keeps its content
+	if _, e := s.Copy("copy/3.txt", "copy//3.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	if bts, _, e := s.File("copy/3.txt").Bytes(); e != nil || string(bts) != string(blob) {
+		t.Error("self copy content invalid.", string(bts), e)
+		return
+	}
+	//2. rename the copy
+	if _, e := s.Rename("copy/3.txt", "rename/3.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	if exists, _, _ := s.File("copy/3.txt").Exist(); exists {
+		t.Error("renamed file should not exist.")
+		return
+	}
+	//3. check both files
+	for _, key := range []string{"3.txt", "rename/3.txt"} {
+		bts, _, e := s.File(key).Bytes()
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		if string(bts) != string(blob) {
+			t.Error("get content invalid. key:", key)
+			return
+		}
+		if _, e = s.File(key).Delete(); e != nil {
+			t.Error(e)
+			return
+		}
+	}
+}
+
+func Test_BatchDelete(t *testing.T) {
+	s := &storage{dir: getCurrentPath()}
+	keys := []string{"batch/1.txt", "batch/2.txt", "batch/3.txt"}
+	for _, key := range keys[:2] {
+		f, e := create(join(s.dir, key))
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		f.Close()
+	}
+	errs := s.BatchDelete(keys)
+	if errs[0] != nil || errs[1] != nil {
+		t.Error("delete files failed.", errs)
+		return
+	}
+	if errs[2] != nil {
+		t.Error("delete missing file should be ignored.", errs[2])
+		return
+	}
+}
+
+func Test_Symlink(t *testing.T) {
+	s := &storage{dir: getCurrentPath()}
+	blob := []byte("testest")
+	if _, e := s.StoreFile("4.txt", blob); e != nil {
+		t.Error(e)
+		return
+	}
+	defer s.File("4.txt").Delete()
+	//1. alias in a sub dir
+	if _, e := s.Symlink("alias/4.txt", "4.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	defer s.File("alias/4.txt").Delete()
+	f := s.File("alias/4.txt").(*file)
+	if symlink, e := f.IsSymlink(); e != nil || !symlink {
+		t.Error("alias should be a symlink.", e)
+		return
+	}
+	//2. read through the alias
+	bts, _, e := f.Bytes()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if string(bts) != string(blob) {
+		t.Error("get content invalid.")
+		return
+	}
+	m, e := f.Meta()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if target := m.Fetch(SYMLINKTARGETKEY); target != "4.txt" {
+		t.Error("unexpected target:", target)
+		return
+	}
+	//3. targets out of the root are refused
+	if _, e := s.Symlink("escape.txt", "../../escape.txt"); e != ErrOutsideRoot {
+		t.Error("expected ErrOutsideRoot, got:", e)
+		return
+	}
+	//4. a chain of links escaping the root is refused as well
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	if e := ioutil.WriteFile(outside, blob, 0644); e != nil {
+		t.Error(e)
+		return
+	}
+	if e := os.Symlink(outside, join(s.dir, "hop.txt")); e != nil {
+		t.Error(e)
+		return
+	}
+	defer s.File("hop.txt").Delete()
+	if _, e := s.Symlink("chain.txt", "hop.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	defer s.File("chain.txt").Delete()
+	if _, _, e := s.File("chain.txt").Bytes(); e != ErrOutsideRoot {
+		t.Error("expected ErrOutsideRoot for a chain, got:", e)
+	}
+}
+
+// create truncates or creates the file of path, along with its parent dirs.
+func create(p string) (*os.File, error) {
+	if err := os.MkdirAll(path.Dir(p), 0777); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+}
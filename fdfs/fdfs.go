@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"sync"
 	"time"
 )
@@ -13,9 +17,15 @@ type client interface {
 	//DownloadToBufferByOffset download to buffer by offset
 	DownloadToBufferByOffset(fileId string, offset, size int64) ([]byte, error)
 
+	// download to writer by offset, size 0 downloads to the end of the file
+	DownloadToWriter(fileId string, w io.Writer, offset, size int64) (int64, error)
+
 	// upload by buffer
 	UploadByBuffer(groupName string, filebuffer []byte, fileExtName string) (string, error)
 
+	// upload size bytes of r, appender is true to upload an appender file
+	UploadByReader(groupName string, r io.Reader, size int64, fileExtName string, appender bool) (string, error)
+
 	// upload appender
 	UploadAppenderByBuffer(groupName string, filebuffer []byte, fileExtName string) (string, error)
 
@@ -27,6 +37,24 @@ type client interface {
 
 	// delete file
 	DeleteFile(remoteFileId string) error
+
+	// query file size, create time, crc32 and source ip
+	QueryFileInfo(remoteFileId string) (*fileInfo, error)
+
+	// query file info from the source storage, which appends, modifies and truncates are sent to
+	QuerySourceFileInfo(remoteFileId string) (*fileInfo, error)
+
+	// set metadata, flag is STORAGE_SET_METADATA_FLAG_OVERWRITE or STORAGE_SET_METADATA_FLAG_MERGE
+	SetMetadata(remoteFileId string, meta map[string]string, flag byte) error
+
+	// get metadata
+	GetMetadata(remoteFileId string) (map[string]string, error)
+
+	// modify appender file at offset
+	ModifyFile(fileBuffer []byte, offset int64, appenderFileId string) error
+
+	// truncate appender file to size
+	TruncateFile(appenderFileId string, size int64) error
 }
 
 // ClientConfig
@@ -40,6 +68,9 @@ type clientConfig struct {
 	SocketIdleTime time.Duration
 
 	IoTimeout time.Duration
+
+	//timeout to get a connection from a pool
+	AcquireTimeout time.Duration
 }
 
 type fdfsClient struct {
@@ -49,12 +80,15 @@ type fdfsClient struct {
 	// // clusterName
 	// clusterName string
 
-	//tracker client containing a connetction pool
-	tracker *trackerClient
+	//trackers each containing a connetction pool
+	tracker *trackerGroup
 
 	//storage client map
 	storages *safeMap
 
+	//storages failed to download, mapped to the time they are remembered until
+	failures *safeMap
+
 	//use to read or write a storage client from map
 	mutex sync.RWMutex
 }
@@ -62,14 +96,14 @@ type fdfsClient struct {
 // var clients = NewSafeMap()
 // var mutex = sync.Mutex{}
 
-//NewFdfsClient create a connection pool to a tracker
-//the tracker is selected randomly from tracker group
+//NewFdfsClient create a connection pool to each tracker of the comma separated trackerHost,
+//the trackers are selected round robin
 func newfdfsClient(trackerHost string, trackerPort int, config *clientConfig) (client, error) {
-	tc, err := newTrackerClient(trackerHost, trackerPort, config)
+	tc, err := newTrackerGroup(trackerHost, trackerPort, config)
 	if err != nil {
 		return nil, err
 	}
-	return &fdfsClient{tracker: tc, storages: newsafeMap(), config: config}, nil
+	return &fdfsClient{tracker: tc, storages: newsafeMap(), failures: newsafeMap(), config: config}, nil
 }
 
 func newfdfsClient1(trackerHost string, trackerPort int) (client, error) {
@@ -78,11 +112,11 @@ func newfdfsClient1(trackerHost string, trackerPort int) (client, error) {
 		SocketPoolSize: 3,
 		ConnectTimeout: 3 * time.Second,
 		IoTimeout:      3 * time.Second}
-	tc, err := newTrackerClient(trackerHost, trackerPort, conf)
+	tc, err := newTrackerGroup(trackerHost, trackerPort, conf)
 	if err != nil {
 		return nil, err
 	}
-	return &fdfsClient{tracker: tc, storages: newsafeMap(), config: conf}, nil
+	return &fdfsClient{tracker: tc, storages: newsafeMap(), failures: newsafeMap(), config: conf}, nil
 }
 
 // DownloadToBuffer
@@ -94,6 +128,10 @@ func (this *fdfsClient) DownloadToBufferByOffset(fileId string, offset, size int
 	return this.downloadToBufferByOffset(fileId, offset, size)
 }
 
+func (this *fdfsClient) DownloadToWriter(fileId string, w io.Writer, offset, size int64) (int64, error) {
+	return this.downloadToWriter(fileId, w, offset, size)
+}
+
 func (this *fdfsClient) AppendFile(fileBuffer []byte, appenderFileId string) error {
 
 	//split file id to two parts: group name and file name
@@ -114,6 +152,42 @@ func (this *fdfsClient) AppendFile(fileBuffer []byte, appenderFileId string) err
 	return storeClient.storageAppendFile(storeInfo, fileBuffer, appenderFileName)
 }
 
+func (this *fdfsClient) ModifyFile(fileBuffer []byte, offset int64, appenderFileId string) error {
+	groupName, appenderFileName, err := splitFileId(appenderFileId)
+	if err != nil {
+		return err
+	}
+	//query a upload server from tracker
+	storeInfo, err := this.tracker.trackerQueryStorageUpdate(groupName, appenderFileName)
+	if err != nil {
+		return err
+	}
+	//get a storage client from storage map, if not exist, create a new storage client
+	storeClient, err := this.getStorage(storeInfo.ipAddr, storeInfo.port)
+	if err != nil {
+		return err
+	}
+	return storeClient.storageModifyFile(storeInfo, fileBuffer, offset, appenderFileName)
+}
+
+func (this *fdfsClient) TruncateFile(appenderFileId string, size int64) error {
+	groupName, appenderFileName, err := splitFileId(appenderFileId)
+	if err != nil {
+		return err
+	}
+	//query a upload server from tracker
+	storeInfo, err := this.tracker.trackerQueryStorageUpdate(groupName, appenderFileName)
+	if err != nil {
+		return err
+	}
+	//get a storage client from storage map, if not exist, create a new storage client
+	storeClient, err := this.getStorage(storeInfo.ipAddr, storeInfo.port)
+	if err != nil {
+		return err
+	}
+	return storeClient.storageTruncateFile(storeInfo, size, appenderFileName)
+}
+
 func (this *fdfsClient) UploadAppenderByBuffer(groupName string, filebuffer []byte,
 	fileExtName string) (string, error) {
 
@@ -126,20 +200,48 @@ func (this *fdfsClient) UploadByBuffer(groupName string, filebuffer []byte,
 	return this.upload(groupName, filebuffer, fileExtName, STORAGE_PROTO_CMD_UPLOAD_FILE)
 }
 
-// UploadByBuffer
+func (this *fdfsClient) UploadByReader(groupName string, r io.Reader, size int64,
+	fileExtName string, appender bool) (string, error) {
+	cmd := STORAGE_PROTO_CMD_UPLOAD_FILE
+	if appender {
+		cmd = STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE
+	}
+	storeClient, storeInfo, err := this.queryUpload(groupName)
+	if err != nil {
+		return "", err
+	}
+	return storeClient.storageUploadByReader(storeInfo, r, size, fileExtName, cmd)
+}
+
+// UploadByBuffer, the tracker chooses the group if groupName is empty
 func (this *fdfsClient) upload(groupName string, filebuffer []byte,
 	fileExtName string, cmd int) (string, error) {
-	//query a upload server from tracker
-	storeInfo, err := this.tracker.queryStroageStoreWithGroup(groupName)
+	storeClient, storeInfo, err := this.queryUpload(groupName)
 	if err != nil {
 		return "", err
 	}
+	return storeClient.storageUploadByBuffer(storeInfo, filebuffer, fileExtName, cmd)
+}
+
+//queryUpload returns the storage to upload to, the tracker chooses the group if groupName is empty
+func (this *fdfsClient) queryUpload(groupName string) (*storageClient, *storageInfo, error) {
+	//query a upload server from tracker
+	var storeInfo *storageInfo
+	var err error
+	if len(groupName) > 0 {
+		storeInfo, err = this.tracker.queryStroageStoreWithGroup(groupName)
+	} else {
+		storeInfo, err = this.tracker.queryStorageStoreWithoutGroup()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 	//get a storage client from storage map, if not exist, create a new storage client
 	storeClient, err := this.getStorage(storeInfo.ipAddr, storeInfo.port)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
-	return storeClient.storageUploadByBuffer(storeInfo, filebuffer, fileExtName, cmd)
+	return storeClient, storeInfo, nil
 }
 
 // UploadSlaveByBuffer
@@ -179,9 +281,7 @@ func (this *fdfsClient) DeleteFile(fileId string) error {
 	return storeClient.storageDeleteFile(storeInfo, fileName)
 }
 
-func (this *fdfsClient) downloadToBufferByOffset(fileId string, offset,
-	downloadSize int64) ([]byte, error) {
-	//split file id to two parts: group name and file name
+func (this *fdfsClient) QueryFileInfo(fileId string) (*fileInfo, error) {
 	groupName, fileName, err := splitFileId(fileId)
 	if err != nil {
 		return nil, err
@@ -191,28 +291,168 @@ func (this *fdfsClient) downloadToBufferByOffset(fileId string, offset,
 	if err != nil {
 		return nil, err
 	}
+	//get a storage client from storage map, if not exist, create a new storage client
+	storeClient, err := this.getStorage(storeInfo.ipAddr, storeInfo.port)
+	if err != nil {
+		return nil, err
+	}
+	return storeClient.storageQueryFileInfo(storeInfo, fileName)
+}
 
+//QuerySourceFileInfo works as QueryFileInfo, but asks the storage of TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE,
+//since the one of FETCH_ONE may be a replica which has not synced the last append yet
+func (this *fdfsClient) QuerySourceFileInfo(fileId string) (*fileInfo, error) {
+	groupName, fileName, err := splitFileId(fileId)
+	if err != nil {
+		return nil, err
+	}
+	storeInfo, err := this.tracker.trackerQueryStorageUpdate(groupName, fileName)
+	if err != nil {
+		return nil, err
+	}
+	storeClient, err := this.getStorage(storeInfo.ipAddr, storeInfo.port)
+	if err != nil {
+		return nil, err
+	}
+	return storeClient.storageQueryFileInfo(storeInfo, fileName)
+}
+
+func (this *fdfsClient) SetMetadata(fileId string, meta map[string]string, flag byte) error {
+	groupName, fileName, err := splitFileId(fileId)
+	if err != nil {
+		return err
+	}
+	storeInfo, err := this.tracker.trackerQueryStorageUpdate(groupName, fileName)
+	if err != nil {
+		return err
+	}
 	//get a storage client from storage map, if not exist, create a new storage client
 	storeClient, err := this.getStorage(storeInfo.ipAddr, storeInfo.port)
+	if err != nil {
+		return err
+	}
+	return storeClient.storageSetMetadata(storeInfo, fileName, meta, flag)
+}
+
+func (this *fdfsClient) GetMetadata(fileId string) (map[string]string, error) {
+	groupName, fileName, err := splitFileId(fileId)
+	if err != nil {
+		return nil, err
+	}
+	//query a download server from tracker
+	storeInfo, err := this.tracker.trackerQueryStorageFetch(groupName, fileName)
 	if err != nil {
 		return nil, err
 	}
-	return storeClient.storageDownload(storeInfo, offset, downloadSize, fileName)
+	//get a storage client from storage map, if not exist, create a new storage client
+	storeClient, err := this.getStorage(storeInfo.ipAddr, storeInfo.port)
+	if err != nil {
+		return nil, err
+	}
+	return storeClient.storageGetMetadata(storeInfo, fileName)
+}
+
+func (this *fdfsClient) downloadToBufferByOffset(fileId string, offset,
+	downloadSize int64) ([]byte, error) {
+	buff := new(bytes.Buffer)
+	if _, err := this.downloadToWriter(fileId, buff, offset, downloadSize); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+//downloadToWriter fails over to the next replica unless some bytes are written to w.
+//A whole file is verified by the crc32 of its file id if the id has one.
+func (this *fdfsClient) downloadToWriter(fileId string, w io.Writer, offset,
+	downloadSize int64) (int64, error) {
+	if id, err := parseFileId(fileId); err == nil && id.info.fileSize >= 0 && offset == 0 && downloadSize == 0 {
+		growBuffer(w, id.info.fileSize)
+		hash := crc32.NewIEEE()
+		n, err := this.downloadFromReplicas(fileId, io.MultiWriter(w, hash), offset, downloadSize)
+		if err == nil && hash.Sum32() != id.info.crc32 {
+			err = fmt.Errorf("%w: crc32 %d != %d", ErrCorrupted, hash.Sum32(), id.info.crc32)
+		}
+		return n, err
+	}
+	return this.downloadFromReplicas(fileId, w, offset, downloadSize)
+}
+
+//downloadFromReplicas downloads from the storages holding the file in turn
+func (this *fdfsClient) downloadFromReplicas(fileId string, w io.Writer, offset,
+	downloadSize int64) (int64, error) {
+	//split file id to two parts: group name and file name
+	groupName, fileName, err := splitFileId(fileId)
+	if err != nil {
+		return 0, err
+	}
+	//query all the download servers from tracker
+	storeInfos, err := this.tracker.trackerQueryStorageFetchAll(groupName, fileName)
+	if err != nil {
+		return 0, err
+	}
+	for _, storeInfo := range this.sortByFailure(storeInfos) {
+		var storeClient *storageClient
+		var n int64
+		//get a storage client from storage map, if not exist, create a new storage client
+		if storeClient, err = this.getStorage(storeInfo.ipAddr, storeInfo.port); err == nil {
+			if n, err = storeClient.storageDownloadToWriter(storeInfo, offset, downloadSize, fileName, w); err == nil {
+				this.failures.Remove(storageKey(storeInfo.ipAddr, storeInfo.port))
+				return n, nil
+			}
+		}
+		if n > 0 {
+			return n, err
+		}
+		switch {
+		case isNetError(err):
+			this.failures.Set(storageKey(storeInfo.ipAddr, storeInfo.port), time.Now().Add(replicaFailureTime))
+		//status 2(ENOENT) means the file is not synced to the replica yet
+		case errors.Is(err, ErrNotFound):
+		default:
+			return 0, err
+		}
+	}
+	return 0, err
+}
+
+//replicaFailureTime is how long a storage failed to download is tried after the others
+var replicaFailureTime = 30 * time.Second
+
+//sortByFailure moves the storages failed recently to the end, keeping the order of tracker otherwise
+func (this *fdfsClient) sortByFailure(storeInfos []*storageInfo) []*storageInfo {
+	sorted := make([]*storageInfo, 0, len(storeInfos))
+	failed := make([]*storageInfo, 0)
+	for _, storeInfo := range storeInfos {
+		key := storageKey(storeInfo.ipAddr, storeInfo.port)
+		if until, ok := this.failures.Get(key); ok {
+			if time.Now().Before(until.(time.Time)) {
+				failed = append(failed, storeInfo)
+				continue
+			}
+			this.failures.Remove(key)
+		}
+		sorted = append(sorted, storeInfo)
+	}
+	return append(sorted, failed...)
+}
+
+func storageKey(ip string, port int) string {
+	return fmt.Sprintf("%s-%d", ip, port)
 }
 
 func (this *fdfsClient) getStorage(ip string, port int) (*storageClient, error) {
-	storageKey := fmt.Sprintf("%s-%d", ip, port)
+	key := storageKey(ip, port)
 	//if the storage with the key exists, return the stroage
 	//else create a new stroage and return
 	var (
 		val interface{}
 		ok  bool
 	)
-	if val, ok = this.storages.Get(storageKey); !ok {
+	if val, ok = this.storages.Get(key); !ok {
 		if client, err := newStorageClient(ip, port, this.config); err != nil {
 			return nil, err
 		} else {
-			val, _ = this.storages.SetIfNotExist(storageKey, client)
+			val, _ = this.storages.SetIfNotExist(key, client)
 		}
 	}
 	return val.(*storageClient), nil
@@ -120,6 +120,12 @@ const (
 
 	FDFS_VERSION_SIZE = 6
 
+	//flags of the file size encoded in a file name, as tracker_types.h of fdfs defines them:
+	//FDFS_APPENDER_FILE_SIZE is INFINITE_FILE_SIZE (256 * 1024LL * 1024 * 1024 * 1024 * 1024LL) and
+	//FDFS_TRUNK_FILE_MARK_SIZE is (512 * 1024LL * 1024 * 1024 * 1024 * 1024LL), i.e. bit 58 and bit 59
+	FDFS_APPENDER_FILE_SIZE   = 256 * 1024 * 1024 * 1024 * 1024 * 1024
+	FDFS_TRUNK_FILE_MARK_SIZE = 512 * 1024 * 1024 * 1024 * 1024 * 1024
+
 	TRACKER_QUERY_STORAGE_FETCH_BODY_LEN = (FDFS_GROUP_NAME_MAX_LEN + IP_ADDRESS_SIZE - 1 + FDFS_PROTO_PKG_LEN_SIZE)
 	TRACKER_QUERY_STORAGE_STORE_BODY_LEN = (FDFS_GROUP_NAME_MAX_LEN + IP_ADDRESS_SIZE - 1 + FDFS_PROTO_PKG_LEN_SIZE + 1)
 	//status code, order is important!
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+//fileNameEncoding is the base64 of fdfs file names, which uses '-' and '_' and is not padded
+var fileNameEncoding = base64.RawURLEncoding
+
+//ErrCorrupted occurs when the crc32 of the downloaded content differs from the one of the file id,
+//it is wrapped with the two checksums and can be checked by errors.Is.
+var ErrCorrupted = errors.New("content is corrupted")
+
+//fileId is a file id parsed without asking the storage, which is
+//group_name/M00/00/00/base64_name[trunk_info]random_digits[.ext] for a master file,
+//where the random digits pad [.ext] to FDFS_FILE_EXT_NAME_MAX_LEN+1 chars as
+//storage_format_ext_name of fdfs does. A slave file inserts its prefix before the ext.
+type fileId struct {
+	groupName string
+
+	//info is decoded from the base64 name. The name of an appender file keeps the size
+	//and crc32 of no content, and the one of a slave file keeps those of its master,
+	//so fileSize is -1 and crc32 is 0 for them.
+	info fileInfo
+
+	//trunk is true if the file is stored in a trunk file
+	trunk bool
+
+	appender bool
+
+	//slave is true for a slave file, whose name is longer than the fixed length of a master,
+	//StoreVariant refuses it as a master. Its prefix can not be told from the random digits
+	//of the master, so it is not kept.
+	slave bool
+
+	ext string
+}
+
+//parseFileId decodes the source ip, create time, size and crc32 of a file from its id
+func parseFileId(id string) (*fileId, error) {
+	groupName, name, err := splitFileId(id)
+	if err != nil {
+		return nil, err
+	}
+	//M00/00/00/ is the store path and two levels of dirs
+	end := FDFS_LOGIC_FILE_PATH_LEN + FDFS_FILENAME_BASE64_LENGTH
+	if len(name) < end || name[0] != 'M' || name[3] != '/' || name[6] != '/' || name[9] != '/' {
+		return nil, fmt.Errorf("fdfs file name error.filename:%s", name)
+	}
+	b, err := fileNameEncoding.DecodeString(name[FDFS_LOGIC_FILE_PATH_LEN:end])
+	if err != nil {
+		return nil, fmt.Errorf("fdfs file name error.filename:%s", name)
+	}
+	// #name_fmt |-source_ip(4)-create_timestamp(4)-file_size(8)-crc32(4)|
+	size := int64(binary.BigEndian.Uint64(b[8:16]))
+	f := &fileId{
+		groupName: groupName,
+		info: fileInfo{
+			fileSize:   size,
+			createTime: time.Unix(int64(binary.BigEndian.Uint32(b[4:8])), 0),
+			crc32:      binary.BigEndian.Uint32(b[16:20]),
+			sourceIp:   net.IP(b[0:4]).String(),
+		},
+		trunk:    size&FDFS_TRUNK_FILE_MARK_SIZE != 0,
+		appender: size&FDFS_APPENDER_FILE_SIZE != 0,
+	}
+	//the high 32 bits are random if the top bit is set
+	if size < 0 || f.trunk {
+		f.info.fileSize = size & 0xFFFFFFFF
+	}
+	masterLen := FDFS_NORMAL_LOGIC_FILENAME_LENGTH
+	if f.trunk {
+		if len(name) < end+FDFS_TRUNK_FILE_INFO_LEN {
+			return nil, fmt.Errorf("fdfs trunk file name error.filename:%s", name)
+		}
+		end += FDFS_TRUNK_FILE_INFO_LEN
+		masterLen = FDFS_TRUNK_LOGIC_FILENAME_LENGTH
+	}
+	if i := strings.LastIndexByte(name, '.'); i >= end {
+		f.ext = name[i+1:]
+	}
+	f.slave = len(name) > masterLen
+	if f.appender || f.slave {
+		f.info.fileSize = -1
+		f.info.crc32 = 0
+	}
+	return f, nil
+}
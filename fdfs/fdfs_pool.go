@@ -13,6 +13,16 @@ var (
 	ErrTimeout = errors.New("timeout")
 )
 
+//defaultAcquireTimeout is the timeout to Get if none is configured
+const defaultAcquireTimeout = 3 * time.Second
+
+//connections idle longer than testIdleTime are checked by the tester on checkout,
+//the stale ones are closed by the reaper every reapInterval
+var (
+	testIdleTime = 30 * time.Second
+	reapInterval = time.Minute
+)
+
 //Pool interface describes a connection pool.
 type pool interface {
 	//Get returns an available(new or reused) connection from the pool.
@@ -28,6 +38,16 @@ type pool interface {
 	//Len returns the current number of connections in the pool,
 	//including those that are in use or free.
 	Len() int
+
+	//InUse returns the number of connections checked out by Get.
+	InUse() int
+
+	//Idle returns the number of open connections waiting in the pool.
+	Idle() int
+
+	//CloseIdle closes the open connections waiting in the pool,
+	//Get makes new ones for their slots.
+	CloseIdle()
 }
 
 //blockingPool implements the pool interface.
@@ -36,72 +56,103 @@ type blockingPool struct {
 	//mutex is to make closing the pool and recycling the connection an atomic operation
 	mutex sync.Mutex
 
-	//timeout to Get, default to 3
+	//timeout to Get
 	timeout time.Duration
 
 	//storage for net.Conn connections
 	conns chan *wrappedConn
 
+	//closed when the pool is closed, stops the reaper and the blocked Get
+	done chan struct{}
+
 	//net.Conn generator
 	factory factory
 
+	//tester checks a connection idle longer than testIdleTime, nil to skip the check
+	tester tester
+
 	livetime time.Duration
+
+	//open connections and the ones of them checked out, guarded by mutex
+	open  int
+	inUse int
 }
 
 //factory is a function to create new connections
 //which is provided by the user
 type factory func() (net.Conn, error)
 
-//Create a new blocking pool. As no new connections would be made when the pool is busy,
-//the number of connections of the pool is kept no more than initCap and maxCap does not
-//make sense but the api is reserved. The timeout to block Get() is set to 3 by default
-//concerning that it is better to be related with Get() method.
-func newblockingPool(initCap, maxCap int, livetime time.Duration, ft factory) (pool, error) {
+//tester is a function to check that a connection is still alive
+type tester func(net.Conn) error
+
+//Create a new blocking pool of maxCap slots, the connection of a slot is made by the first
+//Get which takes it, so initCap is only checked and the api is reserved. Get() blocks for at
+//most timeout, which is set to defaultAcquireTimeout if it is not positive. Connections idle
+//longer than livetime are closed and made again.
+func newblockingPool(initCap, maxCap int, livetime, timeout time.Duration, ft factory, tt tester) (pool, error) {
 	if initCap < 0 || maxCap < 1 || initCap > maxCap {
 		return nil, errors.New("invalid capacity settings")
 	}
+	if timeout <= 0 {
+		timeout = defaultAcquireTimeout
+	}
 
 	newPool := &blockingPool{
-		timeout:  3,
+		timeout:  timeout,
 		conns:    make(chan *wrappedConn, maxCap),
+		done:     make(chan struct{}),
 		factory:  ft,
+		tester:   tt,
 		livetime: livetime,
 	}
 
-	for i := 0; i < initCap; i++ {
+	for i := 0; i < maxCap; i++ {
 		newPool.conns <- newPool.wrap(nil)
 	}
+	go newPool.reap()
 	return newPool, nil
 }
 
 //Get blocks for an available connection.
 func (p *blockingPool) Get() (net.Conn, error) {
-	//in case that pool is closed or pool.conns is set to nil
+	p.mutex.Lock()
 	conns := p.conns
+	p.mutex.Unlock()
+	//in case that pool is closed or pool.conns is set to nil
 	if conns == nil {
 		return nil, ErrClosed
 	}
 
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
 	select {
 	case conn := <-conns:
-		if time.Since(conn.start) > p.livetime {
-			if conn.Conn != nil {
-				conn.Conn.Close()
-				conn.Conn = nil
-			}
+		if conn.Conn != nil && !p.alive(conn) {
+			p.discard(conn)
 		}
 		if conn.Conn == nil {
-			var err error
-			conn.Conn, err = p.factory()
+			c, err := p.factory()
 			if err != nil {
 				conn.start = time.Now()
-				p.put(conn)
+				p.mutex.Lock()
+				p.release(conn)
+				p.mutex.Unlock()
 				return nil, err
 			}
+			p.mutex.Lock()
+			conn.Conn = c
+			p.open++
+			p.mutex.Unlock()
 		}
+		p.mutex.Lock()
 		conn.unusable = false
+		conn.checkedOut = true
+		p.inUse++
+		p.mutex.Unlock()
 		return conn, nil
-	case <-time.After(time.Second * p.timeout):
+	case <-p.done:
+		return nil, ErrClosed
+	case <-timer.C:
 		return nil, ErrTimeout
 	}
 }
@@ -109,48 +160,171 @@ func (p *blockingPool) Get() (net.Conn, error) {
 //put puts the connection back to the pool. If the pool is closed, put simply close
 //any connections received and return immediately. A nil net.Conn is illegal and will be rejected.
 func (p *blockingPool) put(conn *wrappedConn) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	//the second close of a connection is ignored
+	if !conn.checkedOut {
+		return nil
+	}
+	conn.checkedOut = false
+	p.inUse--
+
+	//if conn is marked unusable, underlying net.Conn is set to nil
+	if conn.unusable {
+		p.closeConn(conn)
+	}
+	return p.release(conn)
+}
+
+//release puts conn back to the channel with p.mutex held,
+//conn is closed instead if the pool is closed.
+func (p *blockingPool) release(conn *wrappedConn) error {
 	//in case that pool is closed and pool.conns is set to nil
-	conns := p.conns
-	if conns == nil {
+	if p.conns == nil {
 		//conn.Conn is possibly nil coz factory() may fail, in which case conn is immediately
 		//put back to the pool
-		if conn.Conn != nil {
-			conn.Conn.Close()
-			conn.Conn = nil
-		}
+		p.closeConn(conn)
 		return ErrClosed
 	}
+	//It is impossible to block as number of connections is never more than length of channel
+	p.conns <- conn
+	return nil
+}
 
-	//if conn is marked unusable, underlying net.Conn is set to nil
-	if conn.unusable {
-		if conn.Conn != nil {
-			conn.Conn.Close()
-			conn.Conn = nil
+//alive reports whether an idle conn can be reused, the ones idle longer
+//than testIdleTime are checked by the tester.
+func (p *blockingPool) alive(conn *wrappedConn) bool {
+	idle := time.Since(conn.start)
+	if idle > p.livetime {
+		return false
+	}
+	if idle > testIdleTime && p.tester != nil {
+		if p.tester(conn.Conn) != nil {
+			return false
 		}
+		conn.start = time.Now()
 	}
+	return true
+}
 
-	//It is impossible to block as number of connections is never more than length of channel
-	conns <- conn
-	return nil
+//discard closes the underlying net.Conn of an idle conn
+func (p *blockingPool) discard(conn *wrappedConn) {
+	p.mutex.Lock()
+	p.closeConn(conn)
+	p.mutex.Unlock()
 }
 
-//TODO
-//Close set connection channel to nil and close all the relative connections.
-//Yet not implemented.
-func (p *blockingPool) Close() {}
+//closeConn closes the underlying net.Conn with p.mutex held
+func (p *blockingPool) closeConn(conn *wrappedConn) {
+	if conn.Conn != nil {
+		conn.Conn.Close()
+		conn.Conn = nil
+		p.open--
+	}
+}
+
+//reap closes the idle connections which exceed livetime until the pool is closed.
+func (p *blockingPool) reap() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.mutex.Lock()
+		closed := p.conns == nil
+		p.closeIdle(p.livetime)
+		p.mutex.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+//CloseIdle closes all the idle connections, which is needed when the server is found down
+//and the connections made before are likely broken.
+func (p *blockingPool) CloseIdle() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closeIdle(0)
+}
+
+//closeIdle closes the connections waiting in the pool longer than idleTime with p.mutex held
+func (p *blockingPool) closeIdle(idleTime time.Duration) {
+	conns := p.conns
+	if conns == nil {
+		return
+	}
+	//each slot waiting in the channel is visited once
+	for i := len(conns); i > 0; i-- {
+		select {
+		case conn := <-conns:
+			if time.Since(conn.start) > idleTime {
+				p.closeConn(conn)
+			}
+			conns <- conn
+		default:
+			//the rest are taken by Get
+			i = 0
+		}
+	}
+}
+
+//Close set connection channel to nil and close all the idle connections,
+//the ones in use are closed when they are put back.
+func (p *blockingPool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conns := p.conns
+	if conns == nil {
+		return
+	}
+	p.conns = nil
+	close(p.done)
+	for {
+		select {
+		case conn := <-conns:
+			p.closeConn(conn)
+		default:
+			return
+		}
+	}
+}
 
-//TODO
 //Len return the number of current active(in use or available) connections.
 func (p *blockingPool) Len() int {
-	return 0
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.open
+}
+
+func (p *blockingPool) InUse() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.inUse
+}
+
+func (p *blockingPool) Idle() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.open - p.inUse
+}
+
+//markUnusable makes the pool close conn when it is put back,
+//which is needed when conn is left in the middle of a package
+func markUnusable(conn net.Conn) {
+	if c, ok := conn.(*wrappedConn); ok {
+		c.unusable = true
+	}
 }
 
 func (p *blockingPool) wrap(conn net.Conn) *wrappedConn {
 	return &wrappedConn{
-		conn,
-		p,
-		false,
-		time.Now(),
+		Conn:  conn,
+		pool:  p,
+		start: time.Now(),
 	}
 }
 
@@ -161,9 +335,11 @@ type wrappedConn struct {
 	pool     *blockingPool
 	unusable bool
 	start    time.Time
+	//checkedOut is true between Get and Close, guarded by pool.mutex
+	checkedOut bool
 }
 
-//TODO
+//Close puts the connection back to the pool.
 func (c *wrappedConn) Close() error {
 	return c.pool.put(c)
 }
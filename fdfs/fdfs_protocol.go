@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strings"
 	"time"
 )
@@ -16,6 +18,55 @@ type storageInfo struct {
 	storePathIndex int
 }
 
+// fileInfo is the response of STORAGE_PROTO_CMD_QUERY_FILE_INFO
+type fileInfo struct {
+	fileSize   int64
+	createTime time.Time
+	crc32      uint32
+	sourceIp   string
+}
+
+// errors mapped from the errno-style status of fdfs responses, matched by errors.Is.
+// ErrNotFound is the status 2(ENOENT) of a missing file, or of a group unknown to the tracker.
+var (
+	ErrNotFound        = os.ErrNotExist
+	ErrInvalidArgument = errors.New("fdfs invalid argument")
+	ErrNoSpace         = errors.New("fdfs no space left")
+	ErrBusy            = errors.New("fdfs server busy")
+	ErrExist           = errors.New("fdfs file exists")
+	ErrPermission      = errors.New("fdfs permission denied")
+	ErrIO              = errors.New("fdfs io error")
+	ErrNotSupported    = errors.New("fdfs operation not supported")
+)
+
+// statusErrors maps the status of a response header to the errors above
+var statusErrors = map[statusError]error{
+	1:  ErrPermission,      //EPERM
+	2:  ErrNotFound,        //ENOENT
+	5:  ErrIO,              //EIO
+	11: ErrBusy,            //EAGAIN
+	13: ErrPermission,      //EACCES
+	16: ErrBusy,            //EBUSY
+	17: ErrExist,           //EEXIST
+	22: ErrInvalidArgument, //EINVAL
+	28: ErrNoSpace,         //ENOSPC
+	38: ErrNotSupported,    //ENOSYS
+	95: ErrNotSupported,    //EOPNOTSUPP
+}
+
+// statusError is the non-zero status of a response header
+type statusError int8
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("receive status: %d != 0", int(e))
+}
+
+// Is reports whether target is the error mapped from the status
+func (e statusError) Is(target error) bool {
+	err, ok := statusErrors[e]
+	return ok && err == target
+}
+
 type header struct {
 	pkgLen int64
 	cmd    int8
@@ -32,18 +83,6 @@ func splitFileId(fileId string) (string, string, error) {
 	return s[0], s[1], nil
 }
 
-// parseStatusCode
-func parseStatusCode(status int) string {
-	switch status {
-	case 2:
-		return "FileNotExistWarning"
-	case 22:
-		return "InvalidArgumentWarning"
-	default:
-		return "StatusWarning"
-	}
-}
-
 //read fdfs header
 func recvHeader(conn net.Conn, timeout time.Duration) (*header, error) {
 	data, err := tcpRecv(conn, 10, timeout)
@@ -59,13 +98,19 @@ func recvHeader(conn net.Conn, timeout time.Duration) (*header, error) {
 	cmd, _ := buff.ReadByte()
 	status, _ := buff.ReadByte()
 	if status != 0 {
-		return nil, fmt.Errorf("receive status: %d != 0", int(status))
+		return nil, statusError(status)
 	}
 	h.cmd = int8(cmd)
 	h.status = int8(status)
 	return h, nil
 }
 
+//activeTest checks that the server of conn is alive
+func activeTest(conn net.Conn, timeout time.Duration) error {
+	_, err := interactiveWithServer(conn, newHeaderBuffer(FDFS_PROTO_CMD_ACTIVE_TEST, 0), nil, timeout)
+	return err
+}
+
 func recvResponse(conn net.Conn, timeout time.Duration) ([]byte, error) {
 	//receive response header
 	h, err := recvHeader(conn, timeout)
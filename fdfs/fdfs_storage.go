@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"path/filepath"
+	"time"
 )
 
 type storageClient struct {
@@ -16,7 +19,8 @@ type storageClient struct {
 
 func newStorageClient(host string, port int, config *clientConfig) (*storageClient, error) {
 	c := &storageClient{host: host, port: port, config: config}
-	p, e := newblockingPool(config.SocketInitSize, config.SocketPoolSize, config.SocketIdleTime, c.makeConn)
+	p, e := newblockingPool(config.SocketInitSize, config.SocketPoolSize, config.SocketIdleTime,
+		config.AcquireTimeout, c.makeConn, c.activeTest)
 	if e != nil {
 		return nil, e
 	}
@@ -26,10 +30,20 @@ func newStorageClient(host string, port int, config *clientConfig) (*storageClie
 
 func (this *storageClient) storageDownload(storeInfo *storageInfo, offset, downloadSize int64,
 	fileName string) ([]byte, error) {
+	buff := new(bytes.Buffer)
+	if _, err := this.storageDownloadToWriter(storeInfo, offset, downloadSize, fileName, buff); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+//storageDownloadToWriter streams the file to w and returns the number of bytes written
+func (this *storageClient) storageDownloadToWriter(storeInfo *storageInfo, offset, downloadSize int64,
+	fileName string, w io.Writer) (int64, error) {
 	//get a connetion from pool
 	conn, err := getConnFromPool(this)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer conn.Close()
 
@@ -45,7 +59,19 @@ func (this *storageClient) storageDownload(storeInfo *storageInfo, offset, downl
 	// fileName
 	buffer.WriteString(fileName)
 
-	return interactiveWithServerWithRespLimit(conn, buffer, nil, 128*1024*1024, this.config.IoTimeout)
+	if err = tcpSend(conn, buffer.Bytes(), this.config.IoTimeout); err != nil {
+		return 0, err
+	}
+	h, err := recvHeader(conn, this.config.IoTimeout)
+	if err != nil {
+		return 0, err
+	}
+	growBuffer(w, h.pkgLen)
+	n, err := tcpRecvStream(conn, w, h.pkgLen, this.config.IoTimeout)
+	if err != nil {
+		markUnusable(conn)
+	}
+	return n, err
 }
 
 func (this *storageClient) storageDeleteFile(storeInfo *storageInfo, fileName string) error {
@@ -66,6 +92,84 @@ func (this *storageClient) storageDeleteFile(storeInfo *storageInfo, fileName st
 	return err
 }
 
+func (this *storageClient) storageQueryFileInfo(storeInfo *storageInfo, fileName string) (*fileInfo, error) {
+	//get a connetion from pool
+	conn, err := getConnFromPool(this)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buffer := newHeaderBuffer(STORAGE_PROTO_CMD_QUERY_FILE_INFO, FDFS_GROUP_NAME_MAX_LEN+len(fileName))
+	//16 bit groupName
+	buffer.WriteString(fixString(storeInfo.groupName, FDFS_GROUP_NAME_MAX_LEN))
+	// fileNameLen bit fileName
+	buffer.WriteString(fileName)
+
+	recvBuff, err := interactiveWithServer(conn, buffer, nil, this.config.IoTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// #recv_fmt |-file_size(8)-create_timestamp(8)-crc32(8)-source_ip_addr(16)|
+	if len(recvBuff) != 3*FDFS_PROTO_PKG_LEN_SIZE+IP_ADDRESS_SIZE {
+		return nil, fmt.Errorf("recv package length %d != %d", len(recvBuff), 3*FDFS_PROTO_PKG_LEN_SIZE+IP_ADDRESS_SIZE)
+	}
+	return &fileInfo{
+		fileSize:   int64(binary.BigEndian.Uint64(recvBuff[0:8])),
+		createTime: time.Unix(int64(binary.BigEndian.Uint64(recvBuff[8:16])), 0),
+		crc32:      uint32(binary.BigEndian.Uint64(recvBuff[16:24])),
+		sourceIp:   stripString(string(recvBuff[24:40])),
+	}, nil
+}
+
+func (this *storageClient) storageSetMetadata(storeInfo *storageInfo, fileName string,
+	meta map[string]string, flag byte) error {
+	metaBuff, err := packMeta(meta)
+	if err != nil {
+		return err
+	}
+	//get a connetion from pool
+	conn, err := getConnFromPool(this)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//filename_len(8) meta_size(8) op_flag(1) group_name(16) file_name(n) meta(m)
+	buffer := newHeaderBuffer(STORAGE_PROTO_CMD_SET_METADATA, 17+FDFS_GROUP_NAME_MAX_LEN+len(fileName)+len(metaBuff))
+	binary.Write(buffer, binary.BigEndian, int64(len(fileName)))
+	binary.Write(buffer, binary.BigEndian, int64(len(metaBuff)))
+	buffer.WriteByte(flag)
+	//16 bit groupName
+	buffer.WriteString(fixString(storeInfo.groupName, FDFS_GROUP_NAME_MAX_LEN))
+	buffer.WriteString(fileName)
+	buffer.Write(metaBuff)
+
+	_, err = interactiveWithServer(conn, buffer, nil, this.config.IoTimeout)
+	return err
+}
+
+func (this *storageClient) storageGetMetadata(storeInfo *storageInfo, fileName string) (map[string]string, error) {
+	//get a connetion from pool
+	conn, err := getConnFromPool(this)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buffer := newHeaderBuffer(STORAGE_PROTO_CMD_GET_METADATA, FDFS_GROUP_NAME_MAX_LEN+len(fileName))
+	//16 bit groupName
+	buffer.WriteString(fixString(storeInfo.groupName, FDFS_GROUP_NAME_MAX_LEN))
+	// fileNameLen bit fileName
+	buffer.WriteString(fileName)
+
+	recvBuff, err := interactiveWithServer(conn, buffer, nil, this.config.IoTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return unpackMeta(recvBuff), nil
+}
+
 func (this *storageClient) storageAppendFile(storeInfo *storageInfo, fileBuffer []byte, appenderFileName string) error {
 	var (
 		appenderFileNameLen = len(appenderFileName)
@@ -90,25 +194,69 @@ func (this *storageClient) storageAppendFile(storeInfo *storageInfo, fileBuffer
 	return err
 }
 
+func (this *storageClient) storageModifyFile(storeInfo *storageInfo, fileBuffer []byte, offset int64,
+	appenderFileName string) error {
+	//get a connetion from pool
+	conn, err := getConnFromPool(this)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//appender_filename_len(8) file_offset(8) file_size(8) appender_filename(n) file_content
+	buffer := newHeaderBuffer(STORAGE_PROTO_CMD_MODIFY_FILE, 24+len(appenderFileName)+len(fileBuffer))
+	binary.Write(buffer, binary.BigEndian, int64(len(appenderFileName)))
+	binary.Write(buffer, binary.BigEndian, offset)
+	binary.Write(buffer, binary.BigEndian, int64(len(fileBuffer)))
+	buffer.WriteString(appenderFileName)
+
+	_, err = interactiveWithServerWithRespLimit(conn, buffer, fileBuffer, 0, this.config.IoTimeout)
+	return err
+}
+
+func (this *storageClient) storageTruncateFile(storeInfo *storageInfo, size int64, appenderFileName string) error {
+	//get a connetion from pool
+	conn, err := getConnFromPool(this)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//appender_filename_len(8) truncated_file_size(8) appender_filename(n)
+	buffer := newHeaderBuffer(STORAGE_PROTO_CMD_TRUNCATE_FILE, 16+len(appenderFileName))
+	binary.Write(buffer, binary.BigEndian, int64(len(appenderFileName)))
+	binary.Write(buffer, binary.BigEndian, size)
+	buffer.WriteString(appenderFileName)
+
+	_, err = interactiveWithServerWithRespLimit(conn, buffer, nil, 0, this.config.IoTimeout)
+	return err
+}
+
 //stroage upload by buffer
 func (this *storageClient) storageUploadByBuffer(storeInfo *storageInfo, fileBuffer []byte,
 	fileExtName string, cmd int) (string, error) {
-	return this.storageUploadFile(storeInfo, fileBuffer, int8(cmd), "", "", fileExtName)
+	return this.storageUploadFile(storeInfo, bytes.NewReader(fileBuffer), int64(len(fileBuffer)), int8(cmd), "", "", fileExtName)
+}
+
+//stroage upload by reader, size bytes of r are streamed
+func (this *storageClient) storageUploadByReader(storeInfo *storageInfo, r io.Reader, size int64,
+	fileExtName string, cmd int) (string, error) {
+	return this.storageUploadFile(storeInfo, r, size, int8(cmd), "", "", fileExtName)
 }
 
 //storage upload slave by buffer
 func (this *storageClient) storageUploadSlaveByBuffer(storeInfo *storageInfo, fileBuffer []byte,
 	remoteFileId string, prefixName string, fileExtName string) (string, error) {
-	return this.storageUploadFile(storeInfo, fileBuffer, STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, remoteFileId, prefixName, fileExtName)
+	return this.storageUploadFile(storeInfo, bytes.NewReader(fileBuffer), int64(len(fileBuffer)),
+		STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE, remoteFileId, prefixName, fileExtName)
 }
 
 //stroage upload file
-func (this *storageClient) storageUploadFile(storeInfo *storageInfo, fileBuffer []byte, cmd int8,
+func (this *storageClient) storageUploadFile(storeInfo *storageInfo, file io.Reader, fileSize int64, cmd int8,
 	masterFileName string, prefixName string, fileExtName string) (string, error) {
 	var (
 		uploadSlave bool = false
 		headerLen   int  = 15
-		fileSize    int  = len(fileBuffer)
 	)
 	//get a connetion from pool
 	conn, err := getConnFromPool(this)
@@ -124,12 +272,12 @@ func (this *storageClient) storageUploadFile(storeInfo *storageInfo, fileBuffer
 		headerLen = 38 + masterFilenameLen
 	}
 
-	buffer := newHeaderBuffer(cmd, headerLen+fileSize)
+	buffer := newHeaderBuffer(cmd, headerLen+int(fileSize))
 	if uploadSlave {
 		// master file name len
 		binary.Write(buffer, binary.BigEndian, int64(masterFilenameLen))
 		// file size
-		binary.Write(buffer, binary.BigEndian, int64(fileSize))
+		binary.Write(buffer, binary.BigEndian, fileSize)
 		// 16 bit prefixName
 		buffer.WriteString(fixString(prefixName, FDFS_FILE_PREFIX_MAX_LEN))
 		// 6 bit fileExtName
@@ -140,12 +288,12 @@ func (this *storageClient) storageUploadFile(storeInfo *storageInfo, fileBuffer
 		//store_path_index
 		buffer.WriteByte(byte(uint8(storeInfo.storePathIndex)))
 		// file size
-		binary.Write(buffer, binary.BigEndian, int64(fileSize))
+		binary.Write(buffer, binary.BigEndian, fileSize)
 		// 6 bit fileExtName
 		buffer.WriteString(fixString(fileExtName, FDFS_FILE_EXT_NAME_MAX_LEN))
 	}
 
-	recvBuff, err := interactiveWithServerWithRespLimit(conn, buffer, fileBuffer, 130, this.config.IoTimeout)
+	recvBuff, err := interactiveWithServerByReader(conn, buffer, file, fileSize, 130, this.config.IoTimeout)
 	if err != nil {
 		return "", err
 	}
@@ -158,7 +306,29 @@ func (this *storageClient) storageUploadFile(storeInfo *storageInfo, fileBuffer
 	return filepath.Join(groupName, remoteFilename), nil
 }
 
+//check a pooled connection with FDFS_PROTO_CMD_ACTIVE_TEST
+func (this *storageClient) activeTest(conn net.Conn) error {
+	return activeTest(conn, this.config.IoTimeout)
+}
+
 //factory method used to dial
 func (this *storageClient) makeConn() (net.Conn, error) {
 	return net.DialTimeout("tcp", fmt.Sprintf("%s:%d", this.host, this.port), this.config.ConnectTimeout)
 }
+
+//maxGrowSize caps the bytes reserved ahead of a download, since the size is told by the
+//server or decoded from the file id and a broken one must not allocate gigabytes at once
+const maxGrowSize = 16 << 20
+
+//growBuffer reserves up to maxGrowSize bytes for size if w is a bytes.Buffer,
+//the rest grows as the content arrives
+func growBuffer(w io.Writer, size int64) {
+	buff, ok := w.(*bytes.Buffer)
+	if !ok || size <= 0 {
+		return
+	}
+	if size > maxGrowSize {
+		size = maxGrowSize
+	}
+	buff.Grow(int(size))
+}
@@ -1,24 +1,42 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test_Fast(t *testing.T) {
-	fdfsClient, err := newfdfsClient1("host", 22122)
+	server, err := newFakeFdfs(1, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+	fdfsClient, err := newfdfsClient1(server.hosts(), 0)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 	content := []byte("testest")
 
-	path, err := fdfsClient.UploadByBuffer("g1", content, "txt")
+	path, err := fdfsClient.UploadByBuffer(fakeGroup, content, "txt")
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	t.Error("upload success")
+	if !strings.HasPrefix(path, fakeGroup+"/M00/") || !strings.HasSuffix(path, ".txt") {
+		t.Error("upload path invalid. path:", path)
+		return
+	}
 
 	bts, err := fdfsClient.DownloadToBuffer(path)
 	if err != nil {
@@ -29,20 +47,652 @@ func Test_Fast(t *testing.T) {
 		t.Error("download file err. bts:", string(bts))
 		return
 	}
-	t.Error("download success")
 
 	if err = fdfsClient.DeleteFile(path); err != nil {
 		t.Error(err)
 		return
 	}
-	t.Error("delete success")
 
-	_, err = fdfsClient.DownloadToBuffer(path)
+	if _, err = fdfsClient.DownloadToBuffer(path); !errors.Is(err, ErrNotFound) {
+		t.Error("deleted file should be not found. err:", err)
+		return
+	}
+}
+
+func Test_Client(t *testing.T) {
+	server, err := newFakeFdfs(1, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+	c, err := server.client(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//1. the tracker chooses the group
+	id, err := c.UploadAppenderByBuffer("", []byte("0123456789"), "log")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//2. append, modify and truncate the appender file
+	if err = c.AppendFile([]byte("abc"), id); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = c.ModifyFile([]byte("XY"), 2, id); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = c.TruncateFile(id, 12); err != nil {
+		t.Error(err)
+		return
+	}
+	if f := server.file(id); f == nil || string(f.data) != "01XY456789ab" {
+		t.Error("appender file content invalid.")
+		return
+	}
+	//3. download by offset
+	if bts, err := c.DownloadToBufferByOffset(id, 4, 3); err != nil || string(bts) != "456" {
+		t.Error("download by offset invalid.", string(bts), err)
+		return
+	}
+	//4. query file info
+	info, err := c.QueryFileInfo(id)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if info.fileSize != 12 || info.crc32 != crc32.ChecksumIEEE([]byte("01XY456789ab")) || info.sourceIp != "127.0.0.1" {
+		t.Error("file info invalid.", info)
+		return
+	}
+	//5. overwrite and merge metadata
+	if err = c.SetMetadata(id, map[string]string{"width": "150", "height": "100"}, STORAGE_SET_METADATA_FLAG_OVERWRITE); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = c.SetMetadata(id, map[string]string{"width": "300"}, STORAGE_SET_METADATA_FLAG_MERGE); err != nil {
+		t.Error(err)
+		return
+	}
+	if meta, err := c.GetMetadata(id); err != nil || len(meta) != 2 || meta["width"] != "300" || meta["height"] != "100" {
+		t.Error("metadata invalid.", meta, err)
+		return
+	}
+	//6. slave file named by its master
+	slaveId, err := c.UploadSlaveByBuffer([]byte("thumb"), id, "_s", "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if slaveId != strings.TrimSuffix(id, ".log")+"_s.log" {
+		t.Error("slave file id invalid. id:", slaveId)
+		return
+	}
+	if _, err = c.UploadSlaveByBuffer([]byte("thumb"), id, "_s", ""); !errors.Is(err, ErrExist) {
+		t.Error("duplicated slave should exist. err:", err)
+		return
+	}
+	//7. normal files can not be appended
+	normalId, err := c.UploadByBuffer(fakeGroup, []byte("normal"), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = c.AppendFile([]byte("abc"), normalId); !errors.Is(err, ErrInvalidArgument) {
+		t.Error("append normal file should be invalid. err:", err)
+		return
+	}
+	//8. unknown group
+	if _, err = c.UploadByBuffer("group2", []byte("normal"), ""); !errors.Is(err, ErrNotFound) {
+		t.Error("unknown group should be not found. err:", err)
+		return
+	}
+}
+
+func Test_Faults(t *testing.T) {
+	server, err := newFakeFdfs(1, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+	c, err := server.client(&clientConfig{SocketPoolSize: 1, SocketInitSize: 1, SocketIdleTime: time.Minute,
+		ConnectTimeout: time.Second, IoTimeout: 200 * time.Millisecond, AcquireTimeout: time.Second})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	content := []byte(strings.Repeat("0123456789", streamChunkSize/5))
+	id, err := c.UploadByBuffer("", content, "txt")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	storage := server.storages[0]
+	//1. bad status
+	storage.inject(fault{status: 28})
+	if _, err = c.UploadByBuffer("", content, "txt"); !errors.Is(err, ErrNoSpace) {
+		t.Error("bad status should be mapped. err:", err)
+		return
+	}
+	//2. dropped connection, which is not reused
+	storage.inject(fault{drop: true})
+	if _, err = c.DownloadToBuffer(id); !isNetError(err) {
+		t.Error("dropped connection should fail. err:", err)
+		return
+	}
+	if bts, err := c.DownloadToBuffer(id); err != nil || !bytes.Equal(bts, content) {
+		t.Error("download after drop invalid.", err)
+		return
+	}
+	//3. slow response
+	storage.inject(fault{delay: 400 * time.Millisecond})
+	if _, err = c.QueryFileInfo(id); !isNetError(err) {
+		t.Error("slow response should time out. err:", err)
+		return
+	}
+	//4. truncated body
+	storage.inject(fault{truncate: true})
+	if _, err = c.DownloadToBuffer(id); err == nil {
+		t.Error("truncated body should fail.")
+		return
+	}
+	//5. corrupted body is detected by the crc32 of the file id
+	storage.inject(fault{corrupt: true})
+	if _, err = c.DownloadToBuffer(id); !errors.Is(err, ErrCorrupted) {
+		t.Error("corrupted body should fail. err:", err)
+		return
+	}
+	storage.inject(fault{corrupt: true})
+	if _, err = c.DownloadToBufferByOffset(id, 1, 10); err != nil {
+		t.Error("range is not verified.", err)
+		return
+	}
+	//6. each chunk has its own deadline, so a slow but steady transfer succeeds
+	storage.inject(fault{trickle: 100 * time.Millisecond})
+	if bts, err := c.DownloadToBuffer(id); err != nil || !bytes.Equal(bts, content) {
+		t.Error("trickled download invalid.", err)
+		return
+	}
+	storage.inject(fault{stall: 50 * time.Millisecond})
+	if _, err = c.UploadByBuffer("", content, "txt"); err != nil {
+		t.Error("stalled upload should succeed.", err)
+		return
+	}
+	//7. the pool recovers from the broken connections
+	if err = c.DeleteFile(id); err != nil {
+		t.Error(err)
+		return
+	}
+	sc, _ := c.storages.Get(storageKey("127.0.0.1", storage.Addr().(*net.TCPAddr).Port))
+	if p := sc.(*storageClient).pool; p.InUse() != 0 || p.Len() > 1 {
+		t.Error("pool leaks connections.", p.InUse(), p.Len())
+	}
+}
+
+func Test_Trackers(t *testing.T) {
+	server, err := newFakeFdfs(2, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+	c, err := server.client(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//the trackers are used round robin
+	for i := 0; i < 4; i++ {
+		if _, err = c.UploadByBuffer("", []byte("testest"), "txt"); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	cmd := int8(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE)
+	if server.trackers[0].count(cmd) != 2 || server.trackers[1].count(cmd) != 2 {
+		t.Error("trackers are not used round robin.", server.trackers[0].count(cmd), server.trackers[1].count(cmd))
+		return
+	}
+	//the trackers marked down are tried as a last resort
+	server.trackers[0].inject(fault{drop: true})
+	server.trackers[1].inject(fault{drop: true})
+	if _, err = c.UploadByBuffer("", []byte("testest"), "txt"); err != nil {
+		t.Error("trackers marked down should be retried.", err)
+		return
+	}
+	//a closed tracker is marked down and the other one answers
+	server.trackers[0].Close()
+	for i := 0; i < 4; i++ {
+		if _, err = c.UploadByBuffer("", []byte("testest"), "txt"); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if !c.tracker.trackers[0].isDown() || c.tracker.trackers[1].isDown() {
+		t.Error("closed tracker should be marked down.")
+	}
+}
+
+func Test_Replicas(t *testing.T) {
+	server, err := newFakeFdfs(1, 2)
+	if err != nil {
+		t.Skip("replicas need the loopback addresses other than 127.0.0.1.", err)
+	}
+	defer server.Close()
+	c, err := server.client(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	id, err := c.UploadByBuffer("", []byte("testest"), "txt")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//1. the file is not synced to the source storage yet
+	server.storages[0].inject(fault{status: 2})
+	if bts, err := c.DownloadToBuffer(id); err != nil || string(bts) != "testest" {
+		t.Error("download should fail over to the replica.", err)
+		return
+	}
+	//2. the failed storage is tried after the others for a while
+	server.storages[0].inject(fault{drop: true})
+	if _, err := c.DownloadToBuffer(id); err != nil {
+		t.Error("download should fail over to the replica.", err)
+		return
+	}
+	before := server.storages[0].count(STORAGE_PROTO_CMD_DOWNLOAD_FILE)
+	if _, err := c.DownloadToBuffer(id); err != nil {
+		t.Error(err)
+		return
+	}
+	if server.storages[0].count(STORAGE_PROTO_CMD_DOWNLOAD_FILE) != before {
+		t.Error("failed storage should be tried last.")
+		return
+	}
+	//3. other errors are not retried
+	server.storages[1].inject(fault{status: 22})
+	server.storages[0].inject(fault{status: 22})
+	if _, err := c.DownloadToBuffer(id); !errors.Is(err, ErrInvalidArgument) {
+		t.Error("invalid argument should not fail over. err:", err)
+	}
+}
+
+func Test_PackMeta(t *testing.T) {
+	meta := map[string]string{"width": "150", "height": "100", "from": ""}
+	b, err := packMeta(meta)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(b) != "from\x02\x01height\x02100\x01width\x02150" {
+		t.Error("pack meta invalid. b:", string(b))
+		return
+	}
+	m := unpackMeta(b)
+	if len(m) != len(meta) || m["width"] != "150" || m["height"] != "100" {
+		t.Error("unpack meta invalid. m:", m)
+		return
+	}
+	if _, err = packMeta(map[string]string{strings.Repeat("n", FDFS_MAX_META_NAME_LEN+1): ""}); err == nil {
+		t.Error("long name should fail.")
+	}
+}
+
+func Test_TrackerGroup(t *testing.T) {
+	config := &clientConfig{SocketPoolSize: 1}
+	g, err := newTrackerGroup("t1, t2:22123,", 22122, config)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(g.trackers) != 2 || g.trackers[0].port != 22122 || g.trackers[1].host != "t2" || g.trackers[1].port != 22123 {
+		t.Error("parse trackers invalid.")
+		return
+	}
+	if _, err = newTrackerGroup(strings.Repeat("t,", FDFS_MAX_TRACKERS+1), 22122, config); err == nil {
+		t.Error("too many trackers should fail.")
+		return
+	}
+	//wrapped connection errors mark a tracker down as well
+	if !isNetError(fmt.Errorf("recv header: %w", io.ErrUnexpectedEOF)) || isNetError(ErrNotFound) {
+		t.Error("net errors invalid.")
+	}
+}
+
+func Test_Pool(t *testing.T) {
+	dials := 0
+	p, err := newblockingPool(1, 1, time.Minute, 50*time.Millisecond, func() (net.Conn, error) {
+		dials++
+		c, _ := net.Pipe()
+		return c, nil
+	}, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//1. check out the only connection
+	conn, err := p.Get()
 	if err != nil {
-		if !strings.Contains(err.Error(), "receive status: 2 != 0") {
+		t.Error(err)
+		return
+	}
+	if p.Len() != 1 || p.InUse() != 1 || p.Idle() != 0 {
+		t.Error("counts invalid after get.", p.Len(), p.InUse(), p.Idle())
+		return
+	}
+	if _, err = p.Get(); err != ErrTimeout {
+		t.Error("get from a busy pool should time out. err:", err)
+		return
+	}
+	//2. put back twice, the second close is ignored
+	conn.Close()
+	conn.Close()
+	if p.Len() != 1 || p.InUse() != 0 || p.Idle() != 1 {
+		t.Error("counts invalid after put.", p.Len(), p.InUse(), p.Idle())
+		return
+	}
+	if conn, err = p.Get(); err != nil || dials != 1 {
+		t.Error("idle connection should be reused.", err, dials)
+		return
+	}
+	//closed idle connections are made again
+	conn.Close()
+	p.CloseIdle()
+	if p.Len() != 0 || p.Idle() != 0 {
+		t.Error("idle connections should be closed.", p.Len(), p.Idle())
+		return
+	}
+	if conn, err = p.Get(); err != nil || dials != 2 {
+		t.Error("closed connection should be made again.", err, dials)
+		return
+	}
+	//3. close the pool while the connection is in use
+	p.Close()
+	if _, err = p.Get(); err != ErrClosed {
+		t.Error("get from a closed pool should fail. err:", err)
+		return
+	}
+	conn.Close()
+	if p.Len() != 0 {
+		t.Error("connections should be closed with the pool.", p.Len())
+		return
+	}
+	//4. every slot up to maxCap is made on demand, whatever initCap is
+	dials = 0
+	if p, err = newblockingPool(0, 2, time.Minute, 50*time.Millisecond, func() (net.Conn, error) {
+		dials++
+		c, _ := net.Pipe()
+		return c, nil
+	}, nil); err != nil {
+		t.Error(err)
+		return
+	}
+	defer p.Close()
+	for i := 0; i < 2; i++ {
+		if _, err = p.Get(); err != nil {
+			t.Error("get under maxCap should succeed.", i, err)
+			return
+		}
+	}
+	if _, err = p.Get(); err != ErrTimeout || dials != 2 {
+		t.Error("get over maxCap should time out.", err, dials)
+	}
+}
+
+func Test_SortByFailure(t *testing.T) {
+	c := &fdfsClient{failures: newsafeMap()}
+	infos := []*storageInfo{{ipAddr: "s1", port: 23000}, {ipAddr: "s2", port: 23000}, {ipAddr: "s3", port: 23000}}
+	c.failures.Set(storageKey("s1", 23000), time.Now().Add(time.Minute))
+	c.failures.Set(storageKey("s2", 23000), time.Now().Add(-time.Minute))
+	sorted := c.sortByFailure(infos)
+	if sorted[0].ipAddr != "s2" || sorted[1].ipAddr != "s3" || sorted[2].ipAddr != "s1" {
+		t.Error("failed storage should be tried last.")
+		return
+	}
+	if _, ok := c.failures.Get(storageKey("s2", 23000)); ok {
+		t.Error("expired failure should be forgotten.")
+	}
+}
+
+func Test_StatusError(t *testing.T) {
+	var err error = statusError(2)
+	if !errors.Is(err, ErrNotFound) {
+		t.Error("status 2 should be not found.")
+		return
+	}
+	if !errors.Is(statusError(28), ErrNoSpace) || !errors.Is(statusError(16), ErrBusy) {
+		t.Error("status should be mapped to its error.")
+		return
+	}
+	if errors.Is(statusError(22), ErrNotFound) || errors.Is(statusError(99), ErrInvalidArgument) {
+		t.Error("status should not match other errors.")
+		return
+	}
+	if err.Error() != "receive status: 2 != 0" {
+		t.Error("status error message changed. e:", err)
+	}
+}
+
+func Test_ParseFileId(t *testing.T) {
+	for _, c := range []struct {
+		id, ip, ext            string
+		size                   int64
+		crc32                  uint32
+		trunk, appender, slave bool
+	}{
+		//normal file, the high 32 bits of the size are random
+		{"group1/M00/00/00/wKgBbFloLwCAAAABAAAAB5o7jqA123.txt", "192.168.1.108", "txt", 7, 2587594400, false, false, false},
+		//slave file keeps the size and crc32 of its master
+		{"group1/M00/00/00/wKgBbFloLwCAAAABAAAAB5o7jqA123_150x150.jpg", "192.168.1.108", "jpg", -1, 0, false, false, true},
+		//trunk file with trunk info
+		{"group1/M01/0A/0B/CgAAAlloLwCIAAACAAAEAN6tvu8AAAAAAAAAAAAAAAA123.jpg", "10.0.0.2", "jpg", 1024, 0xdeadbeef, true, false, false},
+		{"group1/M01/0A/0B/CgAAAlloLwCIAAACAAAEAN6tvu8AAAAAAAAAAAAAAAA1234567_s", "10.0.0.2", "", -1, 0, true, false, true},
+		//appender file
+		{"group1/M00/00/00/CgAAAlloLwCEAAADAAAAAAAAAAA1234567", "10.0.0.2", "", -1, 0, false, true, false},
+	} {
+		id, err := parseFileId(c.id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if id.groupName != "group1" || id.info.sourceIp != c.ip || id.info.createTime.Unix() != 1500000000 ||
+			id.info.fileSize != c.size || id.info.crc32 != c.crc32 || id.trunk != c.trunk || id.appender != c.appender ||
+			id.slave != c.slave || id.ext != c.ext {
+			t.Error("file id parsed invalid. id:", c.id, *id)
+			return
+		}
+	}
+	//base64 names of files stored by FastDFS, decoded by hand: the high 32 bits of the size are
+	//0x80 and 23 random bits as COMBINE_RAND_FILE_SIZE makes them, which never reach the
+	//appender(1<<58) and trunk(1<<59) flags, and the ext is padded by digits to a name of 44 chars
+	for _, c := range []struct {
+		id, ip, ext string
+		created     int64
+		size        int64
+		crc32       uint32
+		slave       bool
+	}{
+		{"group1/M00/00/00/wKgBaFv9Ad-Abep_AAUtbU7xcws013.png", "192.168.1.104", "png", 1543307743, 339309, 0x4ef1730b, false},
+		{"group1/M00/00/00/rBEAAljkMxaAHH5kAAAXbqNhG5w582.jpg", "172.17.0.2", "jpg", 1491350294, 5998, 0xa3611b9c, false},
+		//its slave, named by fdfs_gen_slave_filename
+		{"group1/M00/00/00/rBEAAljkMxaAHH5kAAAXbqNhG5w582_150x150.webp", "172.17.0.2", "webp", 1491350294, -1, 0, true},
+	} {
+		id, err := parseFileId(c.id)
+		if err != nil {
 			t.Error(err)
 			return
 		}
+		if id.info.sourceIp != c.ip || id.info.createTime.Unix() != c.created || id.info.fileSize != c.size ||
+			id.info.crc32 != c.crc32 || id.slave != c.slave || id.trunk || id.appender || id.ext != c.ext {
+			t.Error("fdfs file id parsed invalid. id:", c.id, *id)
+			return
+		}
+	}
+	for _, id := range []string{"a.jpg", "group1/a.jpg", "group1/M00/00/00/wKgBbFloLwCAAAAB", "group1/M01/0A/0B/CgAAAlloLwCIAAACAAAEAN6tvu8.jpg"} {
+		if _, err := parseFileId(id); err == nil {
+			t.Error("invalid file id should fail. id:", id)
+			return
+		}
+	}
+}
+
+func Test_DetectFileExt(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0Aimage")
+	for _, c := range []struct {
+		name    string
+		content []byte
+		ext     string
+	}{
+		{"a/b.jpg", png, "jpg"},
+		{"a.dir/b", png, "png"},
+		{"b.toolongext", []byte("plain text"), "txt"},
+		{"", []byte{0, 1, 2}, ""},
+	} {
+		if ext := detectFileExt(c.name, c.content); ext != c.ext {
+			t.Error("detect ext invalid. name:", c.name, "ext:", ext)
+		}
+	}
+}
+
+func Test_FileIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+	idx, err := openFileIndex(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	idx.Put("a.jpg", "g1/M00/00/00/a.jpg")
+	idx.Put("b.jpg", "g1/M00/00/00/b.jpg")
+	idx.Put("a.jpg", "g1/M00/00/00/c.jpg")
+	idx.Delete("b.jpg")
+	//a log has only one index at a time
+	if _, err = openFileIndex(path); err != ErrIndexInUse {
+		t.Error("open an index in use should fail. err:", err)
+		return
+	}
+	//a line broken by a crash is skipped
+	idx.log.WriteString(`{"k":"d.jpg","v`)
+	idx.Close()
+	//reopen from the log
+	if idx, err = openFileIndex(path); err != nil {
+		t.Error(err)
+		return
+	}
+	if id, ok, _ := idx.Get("a.jpg"); !ok || id != "g1/M00/00/00/c.jpg" {
+		t.Error("get replaced key invalid. id:", id)
+		return
+	}
+	for _, key := range []string{"b.jpg", "d.jpg"} {
+		if _, ok, _ := idx.Get(key); ok {
+			t.Error("key should not exist. key:", key)
+			return
+		}
+	}
+}
+
+func Test_Iterator(t *testing.T) {
+	if _, err := (&storage{}).Iterator("", "").Next(); err != ErrNoIndex {
+		t.Error("iterate without index should fail. err:", err)
+		return
+	}
+	idx, err := openFileIndex(filepath.Join(t.TempDir(), "index"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, key := range []string{"b/2.jpg", "a/1.jpg", "b/1.jpg", "c/1.jpg", "b/3.jpg"} {
+		idx.Put(key, "g1/M00/00/00/"+key)
+	}
+	//keys are kept in order by Put and Delete
+	idx.Put("b/1.jpg", "g1/M00/00/00/b/4.jpg")
+	idx.Delete("b/3.jpg")
+	for _, c := range []struct {
+		prefix, lastKey string
+		limit           int
+		keys            string
+	}{
+		{"", "", 10, "a/1.jpg,b/1.jpg,b/2.jpg,c/1.jpg"},
+		{"", "a/1.jpg", 2, "b/1.jpg,b/2.jpg"},
+		{"b/", "a/2.jpg", 10, "b/1.jpg,b/2.jpg"},
+		{"b/", "b/1.jpg", 10, "b/2.jpg"},
+		{"b/", "b/15.jpg", 10, "b/2.jpg"},
+		{"a/", "b/", 10, ""},
+	} {
+		if keys, _ := idx.Keys(c.prefix, c.lastKey, c.limit); strings.Join(keys, ",") != c.keys {
+			t.Error("keys invalid.", c.prefix, c.lastKey, keys)
+			return
+		}
+	}
+	s := &storage{index: idx}
+	iter := s.Iterator("b/", "")
+	f, err := iter.Next()
+	if err != nil || f.Key() != "b/1.jpg" {
+		t.Error("first key invalid.", err)
+		return
+	}
+	//resume from the last key
+	iter = s.Iterator("b/", iter.LastKey())
+	if f, err = iter.Next(); err != nil || f.Key() != "b/2.jpg" {
+		t.Error("resumed key invalid.", err)
+		return
+	}
+	if f, err = iter.Next(); err != nil || f != nil {
+		t.Error("iterator should end.", err)
+	}
+}
+
+func Test_VariantKey(t *testing.T) {
+	s := &storage{}
+	for _, c := range []struct {
+		master, prefix, ext, key string
+	}{
+		{"group1/M00/00/00/wKgAAV.jpg", "_150x150", "", "group1/M00/00/00/wKgAAV_150x150.jpg"},
+		{"group1/M00/00/00/wKgAAV.jpg", "_150x150", "webp", "group1/M00/00/00/wKgAAV_150x150.webp"},
+		{"images.v1/logo", "_s", "", "images.v1/logo_s"},
+	} {
+		if key := s.VariantKey(c.master, c.prefix, c.ext); key != c.key {
+			t.Error("variant key invalid. key:", key)
+		}
+	}
+}
+
+func Test_Stream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	content := []byte(strings.Repeat("0123456789", streamChunkSize/4))
+	go func() {
+		if err := tcpSendStream(client, bytes.NewReader(content), int64(len(content)), time.Second); err != nil {
+			t.Error(err)
+		}
+	}()
+	buff := new(bytes.Buffer)
+	n, err := tcpRecvStream(server, buff, int64(len(content)), time.Second)
+	if err != nil || n != int64(len(content)) || !bytes.Equal(buff.Bytes(), content) {
+		t.Error("stream content invalid.", n, err)
+		return
+	}
+	//the reader is shorter than size
+	go tcpRecvStream(server, ioutil.Discard, 10, time.Second)
+	if err = tcpSendStream(client, bytes.NewReader(content[:5]), 10, time.Second); err == nil {
+		t.Error("short reader should fail.")
+	}
+}
+
+func Test_GrowBuffer(t *testing.T) {
+	buff := new(bytes.Buffer)
+	//a size told by a broken server is not reserved as is
+	growBuffer(buff, 1<<40)
+	if buff.Cap() > 2*maxGrowSize {
+		t.Error("grow should be capped.", buff.Cap())
 		return
 	}
+	growBuffer(buff, -1)
+	growBuffer(ioutil.Discard, 1<<40)
 }
@@ -2,21 +2,187 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+//trackerProbeInterval is the interval to probe a tracker marked down
+var trackerProbeInterval = 5 * time.Second
+
+//trackerGroup selects trackers round robin and skips the ones marked down.
+//A tracker is marked down on network errors and rejoins after it answers FDFS_PROTO_CMD_ACTIVE_TEST.
+type trackerGroup struct {
+	trackers []*trackerClient
+	next     uint32
+}
+
+//newTrackerGroup creates trackers from a comma separated list of host[:port],
+//defaultPort is used by the hosts without port
+func newTrackerGroup(hosts string, defaultPort int, config *clientConfig) (*trackerGroup, error) {
+	g := &trackerGroup{}
+	for _, addr := range strings.Split(hosts, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host, port := addr, defaultPort
+		if strings.Contains(addr, ":") {
+			h, p, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if port, err = strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("fdfs tracker port error.addr:%s", addr)
+			}
+			host = h
+		}
+		tc, err := newTrackerClient(host, port, config)
+		if err != nil {
+			return nil, err
+		}
+		g.trackers = append(g.trackers, tc)
+	}
+	if len(g.trackers) == 0 {
+		return nil, errors.New("no fdfs tracker is configured")
+	}
+	if len(g.trackers) > FDFS_MAX_TRACKERS {
+		return nil, fmt.Errorf("fdfs trackers %d > %d", len(g.trackers), FDFS_MAX_TRACKERS)
+	}
+	return g, nil
+}
+
+func (this *trackerGroup) queryStroageStoreWithGroup(groupName string) (info *storageInfo, err error) {
+	err = this.do(func(tc *trackerClient) (e error) {
+		info, e = tc.queryStroageStoreWithGroup(groupName)
+		return
+	})
+	return
+}
+
+func (this *trackerGroup) queryStorageStoreWithoutGroup() (info *storageInfo, err error) {
+	err = this.do(func(tc *trackerClient) (e error) {
+		info, e = tc.queryStorageStoreWithoutGroup()
+		return
+	})
+	return
+}
+
+func (this *trackerGroup) trackerQueryStorageUpdate(groupName string, remoteFilename string) (info *storageInfo, err error) {
+	err = this.do(func(tc *trackerClient) (e error) {
+		info, e = tc.trackerQueryStorageUpdate(groupName, remoteFilename)
+		return
+	})
+	return
+}
+
+func (this *trackerGroup) trackerQueryStorageFetch(groupName string, fileName string) (info *storageInfo, err error) {
+	err = this.do(func(tc *trackerClient) (e error) {
+		info, e = tc.trackerQueryStorageFetch(groupName, fileName)
+		return
+	})
+	return
+}
+
+func (this *trackerGroup) trackerQueryStorageFetchAll(groupName string, fileName string) (infos []*storageInfo, err error) {
+	err = this.do(func(tc *trackerClient) (e error) {
+		infos, e = tc.trackerQueryStorageFetchAll(groupName, fileName)
+		return
+	})
+	return
+}
+
+//do runs query on the live trackers round robin until one answers,
+//the trackers marked down are tried as a last resort.
+func (this *trackerGroup) do(query func(tc *trackerClient) error) error {
+	n := uint32(len(this.trackers))
+	start := atomic.AddUint32(&this.next, 1)
+	var err error
+	for _, down := range []bool{false, true} {
+		for i := uint32(0); i < n; i++ {
+			tc := this.trackers[(start+i)%n]
+			if tc.isDown() != down {
+				continue
+			}
+			e := query(tc)
+			if e == nil {
+				atomic.StoreInt32(&tc.down, 0)
+				return nil
+			}
+			//the tracker is alive if it answers with an error status
+			if !isNetError(e) {
+				return e
+			}
+			tc.markDown()
+			err = e
+		}
+	}
+	return err
+}
+
+//isNetError reports whether err is caused by the connection rather than the server,
+//err may be wrapped
+func isNetError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 type trackerClient struct {
 	host   string
 	port   int
 	config *clientConfig
 	pool
+
+	//down is 1 when the tracker is marked down, accessed atomically
+	down int32
+}
+
+func (this *trackerClient) isDown() bool {
+	return atomic.LoadInt32(&this.down) == 1
+}
+
+//markDown takes the tracker out of rotation and probes it until it answers.
+//The idle connections are closed on both ends, as the ones made before it went down are
+//likely broken and the ones put back by then would make it flap once it rejoins.
+func (this *trackerClient) markDown() {
+	if !atomic.CompareAndSwapInt32(&this.down, 0, 1) {
+		return
+	}
+	this.CloseIdle()
+	go func() {
+		for this.isDown() {
+			time.Sleep(trackerProbeInterval)
+			if this.probe() == nil {
+				this.CloseIdle()
+				atomic.StoreInt32(&this.down, 0)
+			}
+		}
+	}()
+}
+
+//probe sends FDFS_PROTO_CMD_ACTIVE_TEST over a new connection,
+//pooled connections of a down tracker are likely broken
+func (this *trackerClient) probe() error {
+	conn, err := this.makeConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return this.activeTest(conn)
 }
 
 func newTrackerClient(host string, port int, config *clientConfig) (client *trackerClient, err error) {
 	c := &trackerClient{host: host, port: port, config: config}
 	if p, e := newblockingPool(config.SocketInitSize, config.SocketPoolSize,
-		config.SocketIdleTime, c.makeConn); e != nil {
+		config.SocketIdleTime, config.AcquireTimeout, c.makeConn, c.activeTest); e != nil {
 		err = e
 	} else {
 		c.pool = p
@@ -51,6 +217,27 @@ func (this *trackerClient) queryStroageStoreWithGroup(groupName string) (info *s
 	return
 }
 
+//query upload storage of the group chosen by tracker
+func (this *trackerClient) queryStorageStoreWithoutGroup() (*storageInfo, error) {
+	//get a connection from pool
+	conn, err := getConnFromPool(this)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buffer := newHeaderBuffer(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE, 0)
+
+	recvBuff, err := interactiveWithServer(conn, buffer, nil, this.config.IoTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// #recv_fmt |-group_name(16)-ipaddr(16-1)-port(8)-store_path_index(1)|
+	if len(recvBuff) != TRACKER_QUERY_STORAGE_STORE_BODY_LEN {
+		return nil, fmt.Errorf("recv package length %d != %d", len(recvBuff), TRACKER_QUERY_STORAGE_STORE_BODY_LEN)
+	}
+	return castStorageInfo(recvBuff), nil
+}
+
 func (this *trackerClient) trackerQueryStorageUpdate(groupName string, remoteFilename string) (*storageInfo, error) {
 	return this.trackerQueryStorage(groupName, remoteFilename, TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE)
 }
@@ -91,6 +278,41 @@ func (this *trackerClient) trackerQueryStorage(groupName string, fileName string
 	return
 }
 
+//fetch all the storages holding the file from tracker, the first one is the source storage
+func (this *trackerClient) trackerQueryStorageFetchAll(groupName string, fileName string) ([]*storageInfo, error) {
+	//get a connection from pool
+	conn, err := getConnFromPool(this)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buffer := newHeaderBuffer(TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL, FDFS_GROUP_NAME_MAX_LEN+len(fileName))
+	//16 bit groupName
+	buffer.WriteString(fixString(groupName, FDFS_GROUP_NAME_MAX_LEN))
+	// fileName
+	buffer.WriteString(fileName)
+	recvBuff, err := interactiveWithServer(conn, buffer, nil, this.config.IoTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// #recv_fmt |-group_name(16)-ipaddr(16-1)-port(8)-ipaddr(16-1)*n|
+	if len(recvBuff) < TRACKER_QUERY_STORAGE_FETCH_BODY_LEN ||
+		(len(recvBuff)-TRACKER_QUERY_STORAGE_FETCH_BODY_LEN)%(IP_ADDRESS_SIZE-1) != 0 {
+		return nil, fmt.Errorf("recv package length %d is invalid", len(recvBuff))
+	}
+	first := castStorageInfo(recvBuff[:TRACKER_QUERY_STORAGE_FETCH_BODY_LEN])
+	infos := []*storageInfo{first}
+	for b := recvBuff[TRACKER_QUERY_STORAGE_FETCH_BODY_LEN:]; len(b) > 0; b = b[IP_ADDRESS_SIZE-1:] {
+		infos = append(infos, &storageInfo{
+			groupName: first.groupName,
+			ipAddr:    stripString(string(b[:IP_ADDRESS_SIZE-1])),
+			port:      first.port,
+		})
+	}
+	return infos, nil
+}
+
 // group_name(16)-ipaddr(16-1)-port(8)-store_path_index(1)
 func castStorageInfo(b []byte) *storageInfo {
 	info := &storageInfo{}
@@ -103,6 +325,11 @@ func castStorageInfo(b []byte) *storageInfo {
 	return info
 }
 
+//check a pooled connection with FDFS_PROTO_CMD_ACTIVE_TEST
+func (this *trackerClient) activeTest(conn net.Conn) error {
+	return activeTest(conn, this.config.IoTimeout)
+}
+
 //factory method used for dial
 func (this *trackerClient) makeConn() (net.Conn, error) {
 	return net.DialTimeout("tcp", fmt.Sprintf("%s:%d", this.host, this.port), this.config.ConnectTimeout)
@@ -3,8 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"path"
+	"sort"
 	"strings"
 	"time"
 )
@@ -17,6 +21,72 @@ func getFileExt(filename string) string {
 	return ""
 }
 
+//packMeta joins meta as name FDFS_FIELD_SEPERATOR value, records separated by FDFS_RECORD_SEPERATOR
+func packMeta(meta map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(meta))
+	for name, value := range meta {
+		if len(name) > FDFS_MAX_META_NAME_LEN || len(value) > FDFS_MAX_META_VALUE_LEN {
+			return nil, fmt.Errorf("meta %s exceeds %d/%d bytes", name, FDFS_MAX_META_NAME_LEN, FDFS_MAX_META_VALUE_LEN)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buff := new(bytes.Buffer)
+	for i, name := range names {
+		if i > 0 {
+			buff.WriteByte(FDFS_RECORD_SEPERATOR)
+		}
+		buff.WriteString(name)
+		buff.WriteByte(FDFS_FIELD_SEPERATOR)
+		buff.WriteString(meta[name])
+	}
+	return buff.Bytes(), nil
+}
+
+func unpackMeta(b []byte) map[string]string {
+	meta := make(map[string]string)
+	if len(b) == 0 {
+		return meta
+	}
+	for _, record := range strings.Split(string(b), string(FDFS_RECORD_SEPERATOR)) {
+		fields := strings.SplitN(record, string(FDFS_FIELD_SEPERATOR), 2)
+		if len(fields) == 2 {
+			meta[fields[0]] = fields[1]
+		}
+	}
+	return meta
+}
+
+//extensions of the content types sniffed by detectFileExt
+var sniffedExts = map[string]string{
+	"image/jpeg":      "jpg",
+	"image/png":       "png",
+	"image/gif":       "gif",
+	"image/webp":      "webp",
+	"image/bmp":       "bmp",
+	"image/x-icon":    "ico",
+	"video/mp4":       "mp4",
+	"video/webm":      "webm",
+	"audio/mpeg":      "mp3",
+	"application/pdf": "pdf",
+	"application/zip": "zip",
+	"text/plain":      "txt",
+	"text/html":       "html",
+}
+
+//sniffLen is the length of content needed by detectFileExt
+const sniffLen = 512
+
+//detectFileExt returns the ext of name, or sniffs it from the content if name has none.
+//An empty ext is returned if both fail, which is accepted by fdfs.
+func detectFileExt(name string, content []byte) string {
+	if ext := getFileExt(path.Base(name)); len(ext) > 0 && len(ext) <= FDFS_FILE_EXT_NAME_MAX_LEN {
+		return ext
+	}
+	contentType := strings.SplitN(http.DetectContentType(content), ";", 2)[0]
+	return sniffedExts[contentType]
+}
+
 func tcpSend(conn net.Conn, bytesStream []byte, timeout time.Duration) error {
 	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
 		return err
@@ -27,6 +97,48 @@ func tcpSend(conn net.Conn, bytesStream []byte, timeout time.Duration) error {
 	return nil
 }
 
+//streamChunkSize is the size of a chunk sent or received with its own deadline
+const streamChunkSize = 256 * 1024
+
+//tcpSendStream sends size bytes of r in chunks, each chunk has timeout to be sent
+func tcpSendStream(conn net.Conn, r io.Reader, size int64, timeout time.Duration) error {
+	buff := make([]byte, streamChunkSize)
+	for size > 0 {
+		chunk := buff
+		if size < int64(len(chunk)) {
+			chunk = chunk[:size]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+		if err := tcpSend(conn, chunk, timeout); err != nil {
+			return err
+		}
+		size -= int64(len(chunk))
+	}
+	return nil
+}
+
+//tcpRecvStream copies size bytes from conn to w in chunks, each chunk has timeout to be received
+func tcpRecvStream(conn net.Conn, w io.Writer, size int64, timeout time.Duration) (int64, error) {
+	var n int64
+	for n < size {
+		chunk := size - n
+		if chunk > streamChunkSize {
+			chunk = streamChunkSize
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return n, err
+		}
+		m, err := io.CopyN(w, conn, chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
 func tcpRecv(conn net.Conn, bufferSize int64, timeout time.Duration) ([]byte, error) {
 	buff := make([]byte, bufferSize)
 	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
@@ -68,7 +180,7 @@ func interactiveWithServer(conn net.Conn, header *bytes.Buffer, body []byte, tim
 	}
 	//send body
 	if body != nil {
-		if err = tcpSend(conn, body, timeout); err != nil {
+		if err = tcpSendStream(conn, bytes.NewReader(body), int64(len(body)), timeout); err != nil {
 			return
 		}
 	}
@@ -79,15 +191,19 @@ func interactiveWithServer(conn net.Conn, header *bytes.Buffer, body []byte, tim
 }
 
 func interactiveWithServerWithRespLimit(conn net.Conn, header *bytes.Buffer, body []byte, maxPkgLen int64, timeout time.Duration) (recv []byte, err error) {
+	return interactiveWithServerByReader(conn, header, bytes.NewReader(body), int64(len(body)), maxPkgLen, timeout)
+}
+
+//interactiveWithServerByReader streams bodySize bytes of body after header
+func interactiveWithServerByReader(conn net.Conn, header *bytes.Buffer, body io.Reader, bodySize int64, maxPkgLen int64, timeout time.Duration) (recv []byte, err error) {
 	//send header
 	if err = tcpSend(conn, header.Bytes(), timeout); err != nil {
 		return
 	}
 	//send body
-	if body != nil {
-		if err = tcpSend(conn, body, timeout); err != nil {
-			return
-		}
+	if err = tcpSendStream(conn, body, bodySize, timeout); err != nil {
+		markUnusable(conn)
+		return
 	}
 	//receive server response
 	recv, err = recvResponseWithLimit(conn, maxPkgLen, timeout)
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+type fetcher struct {
+	meta map[string]string
+	info *fileInfo
+}
+
+func (m *fetcher) Fetch(key string) string {
+	switch key {
+	case SIZEKEY:
+		return strconv.FormatInt(m.info.fileSize, 10)
+	case CREATETIMEKEY:
+		return m.info.createTime.UTC().Format(http.TimeFormat)
+	}
+	return m.meta[key]
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	. "github.com/ctripcorp/nephele/storage"
@@ -16,7 +19,10 @@ type file struct {
 	connectTimeout time.Duration
 	socketIdleTime time.Duration
 	ioTimeout      time.Duration
-	key            string
+	acquireTimeout time.Duration
+	//index maps key to its file id, nil if key is the file id
+	index keyIndex
+	key   string
 }
 
 func (f *file) Key() string {
@@ -24,47 +30,184 @@ func (f *file) Key() string {
 }
 
 func (f *file) Exist() (bool, string, error) {
-	return false, "", nil
+	client, e := f.createClient()
+	if e != nil {
+		return false, "", e
+	}
+	id, e := f.resolve()
+	if errors.Is(e, ErrNotFound) {
+		return false, "", nil
+	}
+	if e != nil {
+		return false, "", e
+	}
+	if _, e = client.QueryFileInfo(id); e != nil {
+		//status 2(ENOENT) means the file does not exist
+		if errors.Is(e, ErrNotFound) {
+			return false, "", nil
+		}
+		return false, "", e
+	}
+	return true, "", nil
 }
 
 const GROUPKEY = "group"
 const EXTKEY = "ext"
 
+//APPENDERKEY set to "true" uploads an appender file, which accepts later appends
+const APPENDERKEY = "appender"
+
+//SIZEKEY and CREATETIMEKEY fetch the size and the create time of the file from Meta,
+//the create time is formatted as http.TimeFormat
+const SIZEKEY = "Content-Length"
+const CREATETIMEKEY = "X-Fdfs-Create-Time"
+
+//ErrPositionNotEqualToLength occurs when the index to append is not the size of the file
+var ErrPositionNotEqualToLength = errors.New("position is not equal to file length")
+
+//Append appends blob to the file at index and returns the next index to append,
+//index must be the current size of the file. A file is uploaded if the key is empty,
+//or if the key is absent from the key index and index is 0.
 func (f *file) Append(blob []byte, index int64, kvs ...KV) (int64, string, error) {
 	client, e := f.createClient()
 	if e != nil {
 		return 0, "", e
 	}
 	if len(f.key) > 0 {
-		return 0, "", client.AppendFile(blob, f.key)
-	} else {
-		var groupName string
-		var ext string
-		for _, v := range kvs {
-			if v[0] == GROUPKEY {
-				groupName = v[1]
-			} else if v[0] == EXTKEY {
-				ext = v[1]
+		id, indexed, e := f.lookup()
+		if f.index != nil && !indexed && index == 0 && (e == nil || errors.Is(e, ErrNotFound)) {
+			p, e := f.upload(client, f.key, blob, kvs...)
+			if e != nil {
+				return 0, p, e
 			}
-
+			if e = f.index.Put(f.key, p); e != nil {
+				client.DeleteFile(p)
+				return 0, "", e
+			}
+			return int64(len(blob)), p, nil
+		}
+		if e != nil {
+			return 0, "", e
 		}
-		if len(groupName) < 1 || len(ext) < 1 {
-			return 0, "", errors.New("please set group and ext parameters.")
+		//the size is checked on the storage which the append goes to
+		info, e := client.QuerySourceFileInfo(id)
+		if e != nil {
+			return 0, "", e
 		}
-		p, e := client.UploadByBuffer(groupName, blob, ext)
+		if info.fileSize != index {
+			return info.fileSize, "", ErrPositionNotEqualToLength
+		}
+		if e = client.AppendFile(blob, id); e != nil {
+			return index, "", e
+		}
+		return index + int64(len(blob)), "", nil
+	} else {
+		p, e := f.upload(client, "", blob, kvs...)
 		if len(p) > 0 {
 			f.key = p
 		}
-		return 0, p, e
+		if e != nil {
+			return 0, p, e
+		}
+		return int64(len(blob)), p, nil
+	}
+}
+
+//Modify overwrites the appender file at offset with blob.
+func (f *file) Modify(blob []byte, offset int64) error {
+	client, e := f.createClient()
+	if e != nil {
+		return e
+	}
+	id, e := f.resolve()
+	if e != nil {
+		return e
+	}
+	return client.ModifyFile(blob, offset, id)
+}
+
+//Truncate truncates the appender file to size.
+func (f *file) Truncate(size int64) error {
+	client, e := f.createClient()
+	if e != nil {
+		return e
+	}
+	id, e := f.resolve()
+	if e != nil {
+		return e
+	}
+	return client.TruncateFile(id, size)
+}
+
+//upload stores blob as a new file and returns its file id.
+func (f *file) upload(client client, name string, blob []byte, kvs ...KV) (string, error) {
+	return f.uploadReader(client, name, bytes.NewReader(blob), int64(len(blob)), kvs...)
+}
+
+//uploadReader streams size bytes of r as a new file and returns its file id.
+//The tracker chooses the group unless GROUPKEY is set, and the ext is inferred
+//from name or the content of r unless EXTKEY is set.
+func (f *file) uploadReader(client client, name string, r io.Reader, size int64, kvs ...KV) (string, error) {
+	var groupName string
+	var ext string
+	var appender bool
+	for _, v := range kvs {
+		if v[0] == GROUPKEY {
+			groupName = v[1]
+		} else if v[0] == EXTKEY {
+			ext = v[1]
+		} else if v[0] == APPENDERKEY {
+			appender = v[1] == "true"
+		}
+	}
+	if len(ext) < 1 {
+		//peek the head of content for sniffing, which is still uploaded from br
+		br := bufio.NewReaderSize(r, sniffLen)
+		head, _ := br.Peek(sniffLen)
+		ext = detectFileExt(name, head)
+		r = br
 	}
+	p, e := client.UploadByReader(groupName, r, size, ext, appender)
+	if e != nil {
+		return p, e
+	}
+	if meta := metadata(kvs); len(meta) > 0 {
+		e = client.SetMetadata(p, meta, STORAGE_SET_METADATA_FLAG_OVERWRITE)
+	}
+	return p, e
 }
 
+//Delete deletes the file and its entry of the key index,
+//the entry is deleted too if the file is already gone.
 func (f *file) Delete() (string, error) {
 	client, e := f.createClient()
 	if e != nil {
 		return "", e
 	}
-	return "", client.DeleteFile(f.key)
+	id, e := f.resolve()
+	if e != nil {
+		return "", e
+	}
+	e = client.DeleteFile(id)
+	if f.index != nil && (e == nil || errors.Is(e, ErrNotFound)) {
+		if ie := f.index.Delete(f.key); ie != nil {
+			return "", ie
+		}
+	}
+	return "", e
+}
+
+//WriteTo streams the content of the file to w, large files are never held in memory.
+func (f *file) WriteTo(w io.Writer) (int64, error) {
+	client, e := f.createClient()
+	if e != nil {
+		return 0, e
+	}
+	id, e := f.resolve()
+	if e != nil {
+		return 0, e
+	}
+	return client.DownloadToWriter(id, w, 0, 0)
 }
 
 func (f *file) Bytes() ([]byte, string, error) {
@@ -72,16 +215,104 @@ func (f *file) Bytes() ([]byte, string, error) {
 	if e != nil {
 		return nil, "", e
 	}
-	bts, e := client.DownloadToBuffer(f.key)
+	id, e := f.resolve()
+	if e != nil {
+		return nil, "", e
+	}
+	bts, e := client.DownloadToBuffer(id)
 	return bts, "", e
 }
 
 func (f *file) Meta() (Fetcher, error) {
-	return nil, nil
+	client, e := f.createClient()
+	if e != nil {
+		return nil, e
+	}
+	id, e := f.resolve()
+	if e != nil {
+		return nil, e
+	}
+	meta, e := client.GetMetadata(id)
+	if errors.Is(e, ErrNotFound) {
+		//the storage answers ENOENT for a file which has never been given meta,
+		//so the meta is empty if the file itself exists
+		info, e := client.QueryFileInfo(id)
+		if e != nil {
+			return nil, e
+		}
+		return &fetcher{meta: map[string]string{}, info: info}, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	info, e := stat(client, id)
+	if e != nil {
+		return nil, e
+	}
+	return &fetcher{meta: meta, info: info}, nil
 }
 
+//stat returns the size and create time of the file decoded from its id,
+//the storage is asked only if the id does not tell, as for appender and slave files.
+func stat(client client, id string) (*fileInfo, error) {
+	if fid, e := parseFileId(id); e == nil && fid.info.fileSize >= 0 {
+		return &fid.info, nil
+	}
+	return client.QueryFileInfo(id)
+}
+
+//SetMeta merges kvs into the metadata of the file.
 func (f *file) SetMeta(kvs ...KV) error {
-	return nil
+	meta := metadata(kvs)
+	if len(meta) == 0 {
+		return nil
+	}
+	client, e := f.createClient()
+	if e != nil {
+		return e
+	}
+	id, e := f.resolve()
+	if e != nil {
+		return e
+	}
+	return client.SetMetadata(id, meta, STORAGE_SET_METADATA_FLAG_MERGE)
+}
+
+//resolve returns the file id of the key through the key index. Without a key index the key is
+//taken as a file id, and so is a key absent from the index which parses as one, such as a file
+//stored before the index is configured. Other absent keys are ErrNotFound.
+func (f *file) resolve() (string, error) {
+	id, _, e := f.lookup()
+	return id, e
+}
+
+//lookup works as resolve and reports whether the key is in the key index.
+func (f *file) lookup() (string, bool, error) {
+	if f.index == nil {
+		return f.key, false, nil
+	}
+	id, ok, e := f.index.Get(f.key)
+	if e != nil {
+		return "", false, e
+	}
+	if ok {
+		return id, true, nil
+	}
+	if _, e = parseFileId(f.key); e != nil {
+		return f.key, false, ErrNotFound
+	}
+	return f.key, false, nil
+}
+
+//metadata returns kvs except the reserved ones.
+func metadata(kvs []KV) map[string]string {
+	meta := make(map[string]string)
+	for _, kv := range kvs {
+		if kv[0] != GROUPKEY && kv[0] != EXTKEY && kv[0] != APPENDERKEY {
+			meta[kv[0]] = kv[1]
+		}
+	}
+	return meta
 }
 
 var sm = newsafeMap()
@@ -94,7 +325,8 @@ func (f *file) createClient() (client, error) {
 			SocketInitSize: f.socketInitSize,
 			SocketPoolSize: f.socketPoolSize,
 			ConnectTimeout: f.connectTimeout,
-			IoTimeout:      f.ioTimeout})
+			IoTimeout:      f.ioTimeout,
+			AcquireTimeout: f.acquireTimeout})
 		if err != nil {
 			return nil, err
 		}
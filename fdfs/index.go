@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+//keyIndex maps the logical keys of callers to fdfs file ids, since fdfs names the files itself.
+//Any store can back the plugin by implementing it.
+type keyIndex interface {
+	//Get returns the file id of key, ok is false if key is not indexed
+	Get(key string) (fileId string, ok bool, err error)
+
+	//Put maps key to fileId, replacing the previous one
+	Put(key, fileId string) error
+
+	//Swap works as Put and returns the file id it replaces at once, ok is false if key was
+	//not indexed, so that concurrent stores of a key each see the file they replace
+	Swap(key, fileId string) (old string, ok bool, err error)
+
+	//Delete removes key, deleting an absent key is not an error
+	Delete(key string) error
+
+	//Keys returns at most limit keys with prefix after lastKey in ascending order
+	Keys(prefix, lastKey string, limit int) ([]string, error)
+}
+
+//ErrNoIndex occurs when iterating a storage without key index
+var ErrNoIndex = errors.New("fdfs key index is not configured")
+
+//ErrIndexInUse occurs when the log of a fileIndex is already opened, by this or another process
+var ErrIndexInUse = errors.New("fdfs key index is in use")
+
+//indexRecord is one line of the fileIndex log, an empty Id removes the key
+type indexRecord struct {
+	Key string `json:"k"`
+	Id  string `json:"v,omitempty"`
+}
+
+//fileIndex is a keyIndex kept in memory and persisted to an append-only log file.
+//The log is compacted each time it is opened. The records of other writers would never
+//be seen in memory and would be lost by the compaction, so a log has a single fileIndex,
+//which holds an flock on path.lock until it is closed.
+type fileIndex struct {
+	mutex sync.RWMutex
+	ids   map[string]string
+	//keys are the keys of ids in ascending order, so that a page of Keys is found by binary search
+	keys []string
+	log  *os.File
+	lock *os.File
+}
+
+//openFileIndex loads the log of path, ErrIndexInUse is returned if it is opened elsewhere
+func openFileIndex(path string) (*fileIndex, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			err = ErrIndexInUse
+		}
+		return nil, err
+	}
+	idx, err := loadFileIndex(path)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	idx.lock = lock
+	return idx, nil
+}
+
+//loadFileIndex reads the log of path and compacts it
+func loadFileIndex(path string) (*fileIndex, error) {
+	idx := &fileIndex{ids: make(map[string]string)}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var r indexRecord
+			//a broken line is left by a crash during write
+			if json.Unmarshal(scanner.Bytes(), &r) != nil {
+				continue
+			}
+			if r.Id == "" {
+				delete(idx.ids, r.Key)
+			} else {
+				idx.ids[r.Key] = r.Id
+			}
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	//compact the log into a temp file, which replaces the log at once
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(tmp)
+	for key, id := range idx.ids {
+		if err = writeRecord(w, indexRecord{key, id}); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+	if idx.log, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666); err != nil {
+		return nil, err
+	}
+	idx.keys = make([]string, 0, len(idx.ids))
+	for key := range idx.ids {
+		idx.keys = append(idx.keys, key)
+	}
+	sort.Strings(idx.keys)
+	return idx, nil
+}
+
+//Close closes the log and releases it to other fileIndexes.
+func (idx *fileIndex) Close() error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	err := idx.log.Close()
+	//closing the file releases the flock
+	idx.lock.Close()
+	return err
+}
+
+func (idx *fileIndex) Get(key string) (string, bool, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	id, ok := idx.ids[key]
+	return id, ok, nil
+}
+
+func (idx *fileIndex) Put(key, fileId string) error {
+	_, _, err := idx.Swap(key, fileId)
+	return err
+}
+
+func (idx *fileIndex) Swap(key, fileId string) (string, bool, error) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if err := writeRecord(idx.log, indexRecord{key, fileId}); err != nil {
+		return "", false, err
+	}
+	old, ok := idx.ids[key]
+	if !ok {
+		i := sort.SearchStrings(idx.keys, key)
+		idx.keys = append(idx.keys, "")
+		copy(idx.keys[i+1:], idx.keys[i:])
+		idx.keys[i] = key
+	}
+	idx.ids[key] = fileId
+	return old, ok, nil
+}
+
+func (idx *fileIndex) Delete(key string) error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if _, ok := idx.ids[key]; !ok {
+		return nil
+	}
+	if err := writeRecord(idx.log, indexRecord{Key: key}); err != nil {
+		return err
+	}
+	delete(idx.ids, key)
+	i := sort.SearchStrings(idx.keys, key)
+	idx.keys = append(idx.keys[:i], idx.keys[i+1:]...)
+	return nil
+}
+
+//Keys starts at the first key after both lastKey and prefix, the keys with prefix follow it
+//one after another until the first one without.
+func (idx *fileIndex) Keys(prefix, lastKey string, limit int) ([]string, error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	i := sort.SearchStrings(idx.keys, prefix)
+	if lastKey >= prefix {
+		i = sort.SearchStrings(idx.keys, lastKey)
+		if i < len(idx.keys) && idx.keys[i] == lastKey {
+			i++
+		}
+	}
+	keys := make([]string, 0)
+	for ; i < len(idx.keys) && len(keys) < limit && strings.HasPrefix(idx.keys[i], prefix); i++ {
+		keys = append(keys, idx.keys[i])
+	}
+	return keys, nil
+}
+
+//writeRecord writes r as one line, so that a record is appended by a single write
+func writeRecord(w io.Writer, r indexRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	. "github.com/ctripcorp/nephele/storage"
+)
+
+//iteratorPageSize is the number of keys fetched from the key index at a time
+const iteratorPageSize = 1000
+
+//iterator walks the keys with prefix of the key index in ascending order,
+//nil is returned by Next when every key has been walked.
+type iterator struct {
+	storage *storage
+	prefix  string
+	lastKey string
+	//keys fetched but not returned yet
+	keys []string
+}
+
+func (iter *iterator) Next() (File, error) {
+	if iter.storage.index == nil {
+		return nil, ErrNoIndex
+	}
+	if len(iter.keys) == 0 {
+		keys, err := iter.storage.index.Keys(iter.prefix, iter.lastKey, iteratorPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		iter.keys = keys
+	}
+	iter.lastKey, iter.keys = iter.keys[0], iter.keys[1:]
+	return iter.storage.File(iter.lastKey), nil
+}
+
+func (iter *iterator) LastKey() string {
+	return iter.lastKey
+}
@@ -16,6 +16,15 @@ func New(config map[string]string) Storage {
 	connectTimeout, _ := strconv.Atoi(config["connectTimeout"])
 	socketIdleTime, _ := strconv.Atoi(config["socketIdleTime"])
 	ioTimeout, _ := strconv.Atoi(config["ioTimeout"])
+	acquireTimeout, _ := strconv.Atoi(config["acquireTimeout"])
+	var index keyIndex
+	if len(config["indexFile"]) > 0 {
+		fileIndex, err := openFileIndex(config["indexFile"])
+		if err != nil {
+			return nil
+		}
+		index = fileIndex
+	}
 	return &storage{
 		host:           config["host"],
 		port:           port,
@@ -24,5 +33,7 @@ func New(config map[string]string) Storage {
 		connectTimeout: time.Duration(connectTimeout) * time.Second,
 		socketIdleTime: time.Duration(socketIdleTime) * time.Second,
 		ioTimeout:      time.Duration(ioTimeout) * time.Second,
+		acquireTimeout: time.Duration(acquireTimeout) * time.Second,
+		index:          index,
 	}
 }
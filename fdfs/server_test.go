@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fakeGroup = "group1"
+
+//fault is injected into the next request served by a fakeServer.
+type fault struct {
+	//status replies with the status instead of serving the request
+	status byte
+	//delay sleeps before replying
+	delay time.Duration
+	//stall sleeps before reading each chunk of the request body
+	stall time.Duration
+	//drop closes the connection instead of replying
+	drop bool
+	//truncate sends half of the response body and closes the connection
+	truncate bool
+	//trickle sleeps before sending each chunk of the response body
+	trickle time.Duration
+	//corrupt flips the first byte of the response body
+	corrupt bool
+}
+
+type fakeFile struct {
+	data     []byte
+	meta     map[string]string
+	created  time.Time
+	appender bool
+}
+
+//fakeFdfs emulates the trackers and the storages of one fdfs group over tcp.
+//The storages share the files as if they were synced at once.
+type fakeFdfs struct {
+	trackers []*fakeServer
+	storages []*fakeServer
+
+	mutex sync.Mutex
+	files map[string]*fakeFile
+	seq   int
+}
+
+//fakeServer serves the requests of one tracker or storage.
+type fakeServer struct {
+	net.Listener
+	fdfs  *fakeFdfs
+	serve func(cmd int8, body []byte) (byte, []byte)
+
+	mutex    sync.Mutex
+	faults   []fault
+	requests map[int8]int
+	conns    map[net.Conn]bool
+}
+
+//newFakeFdfs starts trackers and storages listening on loopback.
+//The storages of a group share one port in the fdfs protocol, so the replicas
+//listen on 127.0.0.2, 127.0.0.3 and so on, which fails on systems routing only 127.0.0.1.
+func newFakeFdfs(trackers, replicas int) (*fakeFdfs, error) {
+	s := &fakeFdfs{files: make(map[string]*fakeFile)}
+	port := 0
+	for i := 0; i < replicas; i++ {
+		server, err := s.listen(fmt.Sprintf("127.0.0.%d:%d", i+1, port), s.serveStorage)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		port = server.Addr().(*net.TCPAddr).Port
+		s.storages = append(s.storages, server)
+	}
+	for i := 0; i < trackers; i++ {
+		server, err := s.listen("127.0.0.1:0", s.serveTracker)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.trackers = append(s.trackers, server)
+	}
+	return s, nil
+}
+
+func (s *fakeFdfs) listen(addr string, serve func(cmd int8, body []byte) (byte, []byte)) (*fakeServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &fakeServer{Listener: l, fdfs: s, serve: serve,
+		requests: make(map[int8]int), conns: make(map[net.Conn]bool)}
+	go server.accept()
+	return server, nil
+}
+
+func (s *fakeFdfs) Close() {
+	for _, server := range append(s.trackers, s.storages...) {
+		server.Close()
+	}
+}
+
+//hosts returns the addresses of the trackers separated by comma.
+func (s *fakeFdfs) hosts() string {
+	addrs := make([]string, len(s.trackers))
+	for i, tracker := range s.trackers {
+		addrs[i] = tracker.Addr().String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+//client returns a fdfs client connected to the trackers with small pools and timeouts.
+func (s *fakeFdfs) client(config *clientConfig) (*fdfsClient, error) {
+	if config == nil {
+		config = &clientConfig{SocketPoolSize: 2, SocketInitSize: 2, SocketIdleTime: time.Minute,
+			ConnectTimeout: time.Second, IoTimeout: time.Second, AcquireTimeout: time.Second}
+	}
+	c, err := newfdfsClient(s.hosts(), 0, config)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*fdfsClient), nil
+}
+
+//storage returns the plugin connected to the trackers, with a key index if indexFile is not empty.
+func (s *fakeFdfs) storage(indexFile string) *storage {
+	return New(map[string]string{
+		"host":           s.hosts(),
+		"socketPoolSize": "2",
+		"socketInitSize": "2",
+		"connectTimeout": "1",
+		"socketIdleTime": "60",
+		"ioTimeout":      "1",
+		"acquireTimeout": "1",
+		"indexFile":      indexFile,
+	}).(*storage)
+}
+
+//file returns a copy of the file named by file id, nil if it does not exist.
+func (s *fakeFdfs) file(fileId string) *fakeFile {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[strings.TrimPrefix(fileId, fakeGroup+"/")]
+	if !ok {
+		return nil
+	}
+	c := *f
+	c.data = append([]byte(nil), f.data...)
+	return &c
+}
+
+func (s *fakeFdfs) serveTracker(cmd int8, body []byte) (byte, []byte) {
+	switch cmd {
+	case FDFS_PROTO_CMD_ACTIVE_TEST:
+		return 0, nil
+	case TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE:
+		return 0, append(s.storageInfo(0), 0)
+	case TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE:
+		if len(body) != FDFS_GROUP_NAME_MAX_LEN {
+			return 22, nil
+		}
+		if stripString(string(body)) != fakeGroup {
+			return 2, nil
+		}
+		return 0, append(s.storageInfo(0), 0)
+	case TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE,
+		TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL:
+		if len(body) <= FDFS_GROUP_NAME_MAX_LEN {
+			return 22, nil
+		}
+		if stripString(string(body[:FDFS_GROUP_NAME_MAX_LEN])) != fakeGroup {
+			return 2, nil
+		}
+		//the source storage takes the updates, while a file is fetched from the last replica
+		resp := s.storageInfo(0)
+		if cmd == TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE {
+			resp = s.storageInfo(len(s.storages) - 1)
+		}
+		if cmd == TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL {
+			for i := 1; i < len(s.storages); i++ {
+				resp = append(resp, fixString(s.storageIp(i), IP_ADDRESS_SIZE-1)...)
+			}
+		}
+		return 0, resp
+	}
+	return 22, nil
+}
+
+//storageInfo packs group_name(16) ipaddr(16-1) port(8) of the i-th storage
+func (s *fakeFdfs) storageInfo(i int) []byte {
+	buff := new(bytes.Buffer)
+	buff.WriteString(fixString(fakeGroup, FDFS_GROUP_NAME_MAX_LEN))
+	buff.WriteString(fixString(s.storageIp(i), IP_ADDRESS_SIZE-1))
+	binary.Write(buff, binary.BigEndian, int64(s.storages[i].Addr().(*net.TCPAddr).Port))
+	return buff.Bytes()
+}
+
+func (s *fakeFdfs) storageIp(i int) string {
+	return s.storages[i].Addr().(*net.TCPAddr).IP.String()
+}
+
+func (s *fakeFdfs) serveStorage(cmd int8, body []byte) (byte, []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r := &fakeReader{b: body}
+	switch cmd {
+	case FDFS_PROTO_CMD_ACTIVE_TEST:
+		return 0, nil
+	case STORAGE_PROTO_CMD_UPLOAD_FILE, STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE:
+		//store_path_index(1) file_size(8) file_ext_name(6) file_content
+		pathIndex, size, ext := r.byte(), r.int64(), stripString(r.string(FDFS_FILE_EXT_NAME_MAX_LEN))
+		data := r.rest()
+		if r.err || size != int64(len(data)) {
+			return 22, nil
+		}
+		appender := cmd == STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE
+		name := s.newFileName(pathIndex, data, ext, appender)
+		s.files[name] = &fakeFile{data: data, meta: map[string]string{}, created: time.Now(), appender: appender}
+		return 0, []byte(fixString(fakeGroup, FDFS_GROUP_NAME_MAX_LEN) + name)
+	case STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE:
+		//master_len(8) file_size(8) prefix_name(16) file_ext_name(6) master_name file_content
+		masterLen, size := r.int64(), r.int64()
+		prefix, ext := stripString(r.string(FDFS_FILE_PREFIX_MAX_LEN)), stripString(r.string(FDFS_FILE_EXT_NAME_MAX_LEN))
+		master := r.string(int(masterLen))
+		data := r.rest()
+		if r.err || size != int64(len(data)) || len(prefix) < 1 {
+			return 22, nil
+		}
+		if _, ok := s.files[master]; !ok {
+			return 2, nil
+		}
+		name := strings.TrimSuffix(master, "."+getFileExt(master)) + prefix
+		if len(ext) > 0 {
+			name += "." + ext
+		} else if masterExt := getFileExt(master); len(masterExt) > 0 {
+			name += "." + masterExt
+		}
+		if _, ok := s.files[name]; ok {
+			return 17, nil
+		}
+		s.files[name] = &fakeFile{data: data, meta: map[string]string{}, created: time.Now()}
+		return 0, []byte(fixString(fakeGroup, FDFS_GROUP_NAME_MAX_LEN) + name)
+	case STORAGE_PROTO_CMD_APPEND_FILE:
+		//appender_filename_len(8) file_size(8) appender_filename file_content
+		nameLen, size := r.int64(), r.int64()
+		f, status := s.appender(r.string(int(nameLen)))
+		data := r.rest()
+		if r.err || size != int64(len(data)) {
+			return 22, nil
+		}
+		if status != 0 {
+			return status, nil
+		}
+		f.data = append(f.data, data...)
+		return 0, nil
+	case STORAGE_PROTO_CMD_MODIFY_FILE:
+		//appender_filename_len(8) file_offset(8) file_size(8) appender_filename file_content
+		nameLen, offset, size := r.int64(), r.int64(), r.int64()
+		f, status := s.appender(r.string(int(nameLen)))
+		data := r.rest()
+		if r.err || size != int64(len(data)) {
+			return 22, nil
+		}
+		if status != 0 {
+			return status, nil
+		}
+		if offset < 0 || offset > int64(len(f.data)) {
+			return 22, nil
+		}
+		if end := offset + size; end > int64(len(f.data)) {
+			f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+		}
+		copy(f.data[offset:], data)
+		return 0, nil
+	case STORAGE_PROTO_CMD_TRUNCATE_FILE:
+		//appender_filename_len(8) truncated_file_size(8) appender_filename
+		nameLen, size := r.int64(), r.int64()
+		f, status := s.appender(r.string(int(nameLen)))
+		if r.err {
+			return 22, nil
+		}
+		if status != 0 {
+			return status, nil
+		}
+		if size < 0 || size > int64(len(f.data)) {
+			return 22, nil
+		}
+		f.data = f.data[:size]
+		return 0, nil
+	case STORAGE_PROTO_CMD_DOWNLOAD_FILE:
+		//file_offset(8) download_bytes(8) group_name(16) file_name
+		offset, size := r.int64(), r.int64()
+		f, status := s.lookup(r)
+		if status != 0 {
+			return status, nil
+		}
+		if offset < 0 || offset > int64(len(f.data)) || size < 0 {
+			return 22, nil
+		}
+		if size == 0 || offset+size > int64(len(f.data)) {
+			size = int64(len(f.data)) - offset
+		}
+		return 0, f.data[offset : offset+size]
+	case STORAGE_PROTO_CMD_DELETE_FILE:
+		//group_name(16) file_name
+		if _, status := s.lookup(r); status != 0 {
+			return status, nil
+		}
+		delete(s.files, string(body[FDFS_GROUP_NAME_MAX_LEN:]))
+		return 0, nil
+	case STORAGE_PROTO_CMD_QUERY_FILE_INFO:
+		//group_name(16) file_name
+		f, status := s.lookup(r)
+		if status != 0 {
+			return status, nil
+		}
+		buff := new(bytes.Buffer)
+		binary.Write(buff, binary.BigEndian, int64(len(f.data)))
+		binary.Write(buff, binary.BigEndian, f.created.Unix())
+		binary.Write(buff, binary.BigEndian, int64(crc32.ChecksumIEEE(f.data)))
+		buff.WriteString(fixString(s.storageIp(0), IP_ADDRESS_SIZE))
+		return 0, buff.Bytes()
+	case STORAGE_PROTO_CMD_SET_METADATA:
+		//filename_len(8) meta_size(8) op_flag(1) group_name(16) file_name meta
+		nameLen, metaLen, flag := r.int64(), r.int64(), r.byte()
+		group, name := stripString(r.string(FDFS_GROUP_NAME_MAX_LEN)), r.string(int(nameLen))
+		meta := r.string(int(metaLen))
+		if r.err || len(r.rest()) > 0 {
+			return 22, nil
+		}
+		f, ok := s.files[name]
+		if group != fakeGroup || !ok {
+			return 2, nil
+		}
+		switch flag {
+		case STORAGE_SET_METADATA_FLAG_OVERWRITE:
+			f.meta = unpackMeta([]byte(meta))
+		case STORAGE_SET_METADATA_FLAG_MERGE:
+			for k, v := range unpackMeta([]byte(meta)) {
+				f.meta[k] = v
+			}
+		default:
+			return 22, nil
+		}
+		return 0, nil
+	case STORAGE_PROTO_CMD_GET_METADATA:
+		//group_name(16) file_name
+		f, status := s.lookup(r)
+		if status != 0 {
+			return status, nil
+		}
+		//the real storage keeps no meta file for a file without meta and answers ENOENT
+		if len(f.meta) == 0 {
+			return 2, nil
+		}
+		meta, _ := packMeta(f.meta)
+		return 0, meta
+	}
+	return 22, nil
+}
+
+//lookup reads group_name(16) file_name from the rest of r
+func (s *fakeFdfs) lookup(r *fakeReader) (*fakeFile, byte) {
+	group := stripString(r.string(FDFS_GROUP_NAME_MAX_LEN))
+	name := string(r.rest())
+	if r.err {
+		return nil, 22
+	}
+	f, ok := s.files[name]
+	if group != fakeGroup || !ok {
+		return nil, 2
+	}
+	return f, 0
+}
+
+func (s *fakeFdfs) appender(name string) (*fakeFile, byte) {
+	f, ok := s.files[name]
+	if !ok {
+		return nil, 2
+	}
+	if !f.appender {
+		return nil, 22
+	}
+	return f, 0
+}
+
+//newFileName names a file as fdfs does, the base64 name encodes
+//the ip of the storage, the create time, the size and the crc32 of data.
+//The high 32 bits of the size are random with the top bit set, they are a sequence here.
+//An appender file is named with the flag and the size and crc32 of no content.
+func (s *fakeFdfs) newFileName(pathIndex byte, data []byte, ext string, appender bool) string {
+	s.seq++
+	size, crc := uint64(0x80000000|s.seq)<<32, uint32(0)
+	if appender {
+		size |= FDFS_APPENDER_FILE_SIZE
+	} else {
+		size, crc = size|uint64(len(data)), crc32.ChecksumIEEE(data)
+	}
+	buff := new(bytes.Buffer)
+	buff.Write(net.ParseIP(s.storageIp(0)).To4())
+	binary.Write(buff, binary.BigEndian, uint32(time.Now().Unix()))
+	binary.Write(buff, binary.BigEndian, size)
+	binary.Write(buff, binary.BigEndian, crc)
+	name := fmt.Sprintf("M%02X/%02X/%02X/%s", pathIndex, s.seq>>8&0xFF, s.seq&0xFF,
+		base64.RawURLEncoding.EncodeToString(buff.Bytes()))
+	//the ext is padded to a fixed length by digits, which are random in fdfs
+	pad := FDFS_FILE_EXT_NAME_MAX_LEN + 1
+	if len(ext) > 0 {
+		pad -= len(ext) + 1
+		ext = "." + ext
+	}
+	digits := fmt.Sprintf("%07d", s.seq)
+	return name + digits[len(digits)-pad:] + ext
+}
+
+//inject queues faults for the following requests.
+func (s *fakeServer) inject(faults ...fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append(s.faults, faults...)
+}
+
+func (s *fakeServer) nextFault() fault {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.faults) == 0 {
+		return fault{}
+	}
+	f := s.faults[0]
+	s.faults = s.faults[1:]
+	return f
+}
+
+//count returns the number of requests of cmd served, including the faulted ones.
+func (s *fakeServer) count(cmd int8) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests[cmd]
+}
+
+//Close stops listening and closes the open connections.
+func (s *fakeServer) Close() error {
+	err := s.Listener.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *fakeServer) accept() {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		go s.handle(conn)
+	}
+}
+
+//handle serves the requests of conn one by one until it is closed.
+func (s *fakeServer) handle(conn net.Conn) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	for {
+		//pkg_len(8) cmd(1) status(1)
+		h := make([]byte, 10)
+		if _, err := io.ReadFull(conn, h); err != nil {
+			return
+		}
+		pkgLen, cmd := int64(binary.BigEndian.Uint64(h[:8])), int8(h[8])
+		f := s.nextFault()
+		s.mutex.Lock()
+		s.requests[cmd]++
+		s.mutex.Unlock()
+		body := new(bytes.Buffer)
+		for pkgLen > 0 {
+			time.Sleep(f.stall)
+			n, err := io.CopyN(body, conn, min64(pkgLen, streamChunkSize))
+			if err != nil {
+				return
+			}
+			pkgLen -= n
+		}
+		if f.drop {
+			return
+		}
+		time.Sleep(f.delay)
+		status, resp := f.status, []byte(nil)
+		if status == 0 {
+			status, resp = s.serve(cmd, body.Bytes())
+		}
+		if !s.reply(conn, status, resp, f) {
+			return
+		}
+	}
+}
+
+//reply sends the response, false is returned if the connection is closed by the fault
+func (s *fakeServer) reply(conn net.Conn, status byte, resp []byte, f fault) bool {
+	h := new(bytes.Buffer)
+	binary.Write(h, binary.BigEndian, int64(len(resp)))
+	h.WriteByte(STORAGE_PROTO_CMD_RESP)
+	h.WriteByte(status)
+	if _, err := conn.Write(h.Bytes()); err != nil {
+		return false
+	}
+	if f.truncate {
+		conn.Write(resp[:len(resp)/2])
+		return false
+	}
+	if f.corrupt && len(resp) > 0 {
+		resp = append([]byte{resp[0] ^ 0xFF}, resp[1:]...)
+	}
+	for len(resp) > 0 {
+		time.Sleep(f.trickle)
+		chunk := resp[:min64(int64(len(resp)), streamChunkSize)]
+		if _, err := conn.Write(chunk); err != nil {
+			return false
+		}
+		resp = resp[len(chunk):]
+	}
+	return true
+}
+
+//fakeReader reads the fields of a request body, err is set once the body is short
+type fakeReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *fakeReader) next(n int) []byte {
+	if n < 0 || n > len(r.b) {
+		r.err = true
+		n = len(r.b)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *fakeReader) byte() byte {
+	if b := r.next(1); len(b) == 1 {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *fakeReader) int64() int64 {
+	if b := r.next(8); len(b) == 8 {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *fakeReader) string(n int) string {
+	return string(r.next(n))
+}
+
+func (r *fakeReader) rest() []byte {
+	return r.next(len(r.b))
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
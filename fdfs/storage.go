@@ -1,6 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	. "github.com/ctripcorp/nephele/storage"
@@ -14,6 +21,9 @@ type storage struct {
 	connectTimeout time.Duration
 	socketIdleTime time.Duration
 	ioTimeout      time.Duration
+	acquireTimeout time.Duration
+	//index maps logical keys to file ids, nil if keys are file ids
+	index keyIndex
 }
 
 func (s *storage) File(key string) File {
@@ -25,16 +35,213 @@ func (s *storage) File(key string) File {
 		connectTimeout: s.connectTimeout,
 		socketIdleTime: s.socketIdleTime,
 		ioTimeout:      s.ioTimeout,
+		acquireTimeout: s.acquireTimeout,
+		index:          s.index,
 		key:            key,
 	}
 }
 
+//Iterator walks the keys of the key index, ErrNoIndex is returned by Next without one.
 func (s *storage) Iterator(prefix string, lastKey string) Iterator {
-	return nil
+	return &iterator{storage: s, prefix: prefix, lastKey: lastKey}
 }
 
+//StoreFile uploads blob as a new file and returns its file id.
+//With a key index, key is mapped to the new file and the file it replaces is deleted,
+//otherwise key is only used to infer the ext since fdfs names the file itself.
 func (s *storage) StoreFile(key string, blob []byte, kvs ...KV) (string, error) {
-	f := s.File(key)
-	_, k, err := f.Append(blob, 0, kvs...)
-	return k, err
+	return s.StoreReader(key, bytes.NewReader(blob), int64(len(blob)), kvs...)
+}
+
+//StoreReader works as StoreFile, but streams size bytes of r so that large files
+//are never held in memory.
+func (s *storage) StoreReader(key string, r io.Reader, size int64, kvs ...KV) (string, error) {
+	f := s.File("").(*file)
+	client, err := f.createClient()
+	if err != nil {
+		return "", err
+	}
+	fileId, err := f.uploadReader(client, key, r, size, kvs...)
+	if err != nil || s.index == nil || len(key) < 1 {
+		return fileId, err
+	}
+	old, replaced, err := s.index.Swap(key, fileId)
+	if err != nil {
+		//the uploaded file is unreachable without its key
+		client.DeleteFile(fileId)
+		return "", err
+	}
+	if replaced && old != fileId {
+		//the replaced file is unreachable anyway, failing to delete it is not an error of the store
+		client.DeleteFile(old)
+	}
+	return fileId, nil
+}
+
+//StoreVariant stores blob as a slave file of masterKey, such as a thumbnail of an image,
+//and returns the file id of the variant. Its key is always VariantKey(masterKey, prefix, ext),
+//which is mapped to the file id with a key index. Storing a variant again replaces it,
+//a variant can not be the master of another one.
+func (s *storage) StoreVariant(masterKey, prefix, ext string, blob []byte, kvs ...KV) (string, error) {
+	if len(prefix) < 1 || len(prefix) > FDFS_FILE_PREFIX_MAX_LEN || len(ext) > FDFS_FILE_EXT_NAME_MAX_LEN {
+		return "", fmt.Errorf("fdfs variant prefix %q or ext %q is invalid", prefix, ext)
+	}
+	master := s.File(masterKey).(*file)
+	client, err := master.createClient()
+	if err != nil {
+		return "", err
+	}
+	masterId, err := master.resolve()
+	if err != nil {
+		return "", err
+	}
+	//fdfs would name a slave of a slave beyond the length the ids are parsed by
+	if id, err := parseFileId(masterId); err == nil && id.slave {
+		return "", fmt.Errorf("%w: fdfs master %s is a slave file", ErrInvalidArgument, masterId)
+	}
+	slaveExt := ext
+	if len(slaveExt) < 1 {
+		slaveExt = getFileExt(path.Base(masterId))
+	}
+	fileId, err := client.UploadSlaveByBuffer(blob, masterId, prefix, slaveExt)
+	if errors.Is(err, ErrExist) {
+		//fdfs names the slave by its master, so the variant of the same master takes the same id
+		if err = client.DeleteFile(s.VariantKey(masterId, prefix, ext)); err == nil {
+			fileId, err = client.UploadSlaveByBuffer(blob, masterId, prefix, slaveExt)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if meta := metadata(kvs); len(meta) > 0 {
+		if err = client.SetMetadata(fileId, meta, STORAGE_SET_METADATA_FLAG_OVERWRITE); err != nil {
+			client.DeleteFile(fileId)
+			return "", err
+		}
+	}
+	if s.index != nil {
+		old, replaced, err := s.index.Swap(s.VariantKey(masterKey, prefix, ext), fileId)
+		if err != nil {
+			client.DeleteFile(fileId)
+			return "", err
+		}
+		//the variant of a replaced master is a slave of the old master
+		if replaced && old != fileId {
+			client.DeleteFile(old)
+		}
+	}
+	return fileId, nil
+}
+
+//VariantKey computes the key of a variant stored by StoreVariant without any lookup,
+//as fdfs names a slave file by its master: the prefix is inserted before the ext of
+//the master, and the ext of the master is kept if ext is empty.
+func (s *storage) VariantKey(masterKey, prefix, ext string) string {
+	base, masterExt := masterKey, ""
+	if i := strings.LastIndexByte(masterKey, '.'); i > strings.LastIndexByte(masterKey, '/') {
+		base, masterExt = masterKey[:i], masterKey[i+1:]
+	}
+	if len(ext) < 1 {
+		ext = masterExt
+	}
+	if len(ext) < 1 {
+		return base + prefix
+	}
+	return base + prefix + "." + ext
+}
+
+//Copy streams src into a new file, since fdfs has no server side copy.
+//Fdfs names the new file itself, so dst is only mapped to it with a key index,
+//and the new file id is returned.
+//The group, ext and meta of src are used unless kvs override them, the meta in kvs
+//replaces the whole meta of src.
+func (s *storage) Copy(src, dst string, kvs ...KV) (string, error) {
+	f := s.File(src).(*file)
+	client, err := f.createClient()
+	if err != nil {
+		return "", err
+	}
+	srcId, err := f.resolve()
+	if err != nil {
+		return "", err
+	}
+	info, err := stat(client, srcId)
+	if err != nil {
+		return "", err
+	}
+	groupName, fileName, err := splitFileId(srcId)
+	if err != nil {
+		return "", err
+	}
+	srcKvs := []KV{{GROUPKEY, groupName}, {EXTKEY, getFileExt(fileName)}}
+	if len(metadata(kvs)) == 0 {
+		meta, err := client.GetMetadata(srcId)
+		//the storage answers ENOENT for a file which has never been given meta
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return "", err
+		}
+		for k, v := range meta {
+			srcKvs = append(srcKvs, KV{k, v})
+		}
+	}
+	kvs = append(srcKvs, kvs...)
+	r, w := io.Pipe()
+	go func() {
+		_, err := client.DownloadToWriter(srcId, w, 0, 0)
+		w.CloseWithError(err)
+	}()
+	fileId, err := s.StoreReader(dst, r, info.fileSize, kvs...)
+	//unblocks the download if the upload fails
+	r.Close()
+	return fileId, err
+}
+
+//Rename copies src to a new file and deletes src, the new file id is returned.
+func (s *storage) Rename(src, dst string, kvs ...KV) (string, error) {
+	fileId, err := s.Copy(src, dst, kvs...)
+	if err != nil {
+		return "", err
+	}
+	if _, err = s.File(src).Delete(); err != nil {
+		return fileId, err
+	}
+	return fileId, nil
+}
+
+//BatchDelete deletes keys by as many workers as connections of a storage pool.
+//The returned errors are indexed as keys, nil for the deleted and the missing ones.
+func (s *storage) BatchDelete(keys []string) []error {
+	workers := s.socketPoolSize
+	if workers < 1 {
+		workers = 1
+	}
+	return batch(keys, workers, func(key string) error {
+		_, err := s.File(key).Delete()
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+//batch is the one of the disk plugin, see there for its contract.
+func batch(keys []string, workers int, do func(key string) error) []error {
+	errs := make([]error, len(keys))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(keys); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = do(keys[i])
+			}
+		}()
+	}
+	for i := range keys {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return errs
 }
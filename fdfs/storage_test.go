@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/ctripcorp/nephele/storage"
+)
+
+func Test_StoreFile(t *testing.T) {
+	server, err := newFakeFdfs(1, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+	s := server.storage("")
+	//1. without key index the file id is the key
+	fileId, err := s.StoreFile("a/1.jpg", []byte("testest"), KV{"width", "150"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasSuffix(fileId, ".jpg") {
+		t.Error("ext should be inferred from key. fileId:", fileId)
+		return
+	}
+	f := s.File(fileId)
+	if exist, _, err := f.Exist(); err != nil || !exist {
+		t.Error("stored file should exist.", err)
+		return
+	}
+	fetcher, err := f.Meta()
+	if err != nil || fetcher.Fetch("width") != "150" || fetcher.Fetch(SIZEKEY) != "7" {
+		t.Error("meta invalid.", err)
+		return
+	}
+	if created, err := http.ParseTime(fetcher.Fetch(CREATETIMEKEY)); err != nil || time.Since(created) > time.Minute {
+		t.Error("create time invalid.", fetcher.Fetch(CREATETIMEKEY), err)
+		return
+	}
+	//size and create time are decoded from the file id
+	if server.storages[0].count(STORAGE_PROTO_CMD_QUERY_FILE_INFO) != 1 {
+		t.Error("meta should not query file info.")
+		return
+	}
+	//2. the ext is sniffed from the content
+	fileId, err = s.StoreFile("", []byte("\x89PNG\x0D\x0A\x1A\x0Aimage"))
+	if err != nil || !strings.HasSuffix(fileId, ".png") {
+		t.Error("ext should be sniffed. fileId:", fileId, err)
+		return
+	}
+	//a file without meta has empty meta though the storage answers ENOENT
+	if fetcher, err = s.File(fileId).Meta(); err != nil || fetcher.Fetch("width") != "" || fetcher.Fetch(SIZEKEY) != "13" {
+		t.Error("empty meta invalid.", err)
+		return
+	}
+	//3. delete
+	if _, err = s.File(fileId).Delete(); err != nil {
+		t.Error(err)
+		return
+	}
+	if exist, _, err := s.File(fileId).Exist(); err != nil || exist {
+		t.Error("deleted file should not exist.", err)
+		return
+	}
+	if _, _, err = s.File(fileId).Bytes(); !errors.Is(err, ErrNotFound) {
+		t.Error("deleted file should be not found. err:", err)
+		return
+	}
+	if _, err = s.File(fileId).Meta(); !errors.Is(err, ErrNotFound) {
+		t.Error("meta of deleted file should be not found. err:", err)
+	}
+}
+
+func Test_KeyIndex(t *testing.T) {
+	server, err := newFakeFdfs(1, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+	s := server.storage(filepath.Join(t.TempDir(), "index"))
+	//1. a key is mapped to its file
+	oldId, err := s.StoreFile("a/1.jpg", []byte("v1"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//2. storing the key again replaces the old file
+	if _, err = s.StoreFile("a/1.jpg", []byte("v2")); err != nil {
+		t.Error(err)
+		return
+	}
+	if bts, _, err := s.File("a/1.jpg").Bytes(); err != nil || string(bts) != "v2" {
+		t.Error("replaced content invalid.", string(bts), err)
+		return
+	}
+	if server.file(oldId) != nil {
+		t.Error("replaced file should be deleted.")
+		return
+	}
+	//concurrent stores of the key leave only the file of the last one
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.StoreFile("a/1.jpg", []byte("v2")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	server.mutex.Lock()
+	files := len(server.files)
+	server.mutex.Unlock()
+	if files != 1 {
+		t.Error("replaced files should be deleted.", files)
+		return
+	}
+	//3. copy and rename map new keys
+	if _, err = s.Copy("a/1.jpg", "b/1.jpg"); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = s.Rename("b/1.jpg", "b/2.jpg"); err != nil {
+		t.Error(err)
+		return
+	}
+	keys := make([]string, 0)
+	iter := s.Iterator("", "")
+	for f, err := iter.Next(); f != nil || err != nil; f, err = iter.Next() {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		keys = append(keys, f.Key())
+	}
+	if strings.Join(keys, ",") != "a/1.jpg,b/2.jpg" {
+		t.Error("iterated keys invalid. keys:", keys)
+		return
+	}
+	//4. batch delete removes the files and their keys, a missing key is ignored
+	for i, err := range s.BatchDelete([]string{"a/1.jpg", "b/2.jpg", "c/1.jpg"}) {
+		if err != nil {
+			t.Error("batch delete failed. index:", i, err)
+			return
+		}
+	}
+	if f, err := s.Iterator("", "").Next(); f != nil || err != nil {
+		t.Error("keys should be deleted.", err)
+		return
+	}
+	//5. a key absent from the index is not taken as a file id
+	f := s.File("a/1.jpg")
+	if exist, _, err := f.Exist(); err != nil || exist {
+		t.Error("absent key should not exist.", err)
+		return
+	}
+	if _, _, err = f.Bytes(); !errors.Is(err, ErrNotFound) {
+		t.Error("absent key should be not found. err:", err)
+		return
+	}
+	if _, err = f.Delete(); !errors.Is(err, ErrNotFound) {
+		t.Error("delete of absent key should be not found. err:", err)
+		return
+	}
+	//6. the uploaded file is deleted if its key can not be indexed
+	s.index = &brokenIndex{s.index}
+	if _, err = s.StoreFile("c/1.jpg", []byte("v3")); err != errBrokenIndex {
+		t.Error("store should fail with the index. err:", err)
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.files) != 0 {
+		t.Error("files should be deleted.", len(server.files))
+	}
+}
+
+var errBrokenIndex = errors.New("broken index")
+
+//brokenIndex fails every Put and Swap
+type brokenIndex struct {
+	keyIndex
+}
+
+func (idx *brokenIndex) Put(key, fileId string) error {
+	return errBrokenIndex
+}
+
+func (idx *brokenIndex) Swap(key, fileId string) (string, bool, error) {
+	return "", false, errBrokenIndex
+}
+
+func Test_Appender(t *testing.T) {
+	server, err := newFakeFdfs(1, 2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+	s := server.storage(filepath.Join(t.TempDir(), "index"))
+	f := s.File("logs/1.log").(*file)
+	//1. the first append uploads an appender file
+	next, _, err := f.Append([]byte("0123"), 0, KV{APPENDERKEY, "true"})
+	if err != nil || next != 4 {
+		t.Error("first append invalid.", next, err)
+		return
+	}
+	//2. append at the end
+	if next, _, err = f.Append([]byte("4567"), next); err != nil || next != 8 {
+		t.Error("append invalid.", next, err)
+		return
+	}
+	//3. append at a wrong position
+	if next, _, err = f.Append([]byte("89"), 4); err != ErrPositionNotEqualToLength || next != 8 {
+		t.Error("append at wrong position should fail.", next, err)
+		return
+	}
+	//4. modify and truncate
+	if err = f.Modify([]byte("AB"), 6); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = f.Truncate(7); err != nil {
+		t.Error(err)
+		return
+	}
+	//the size to append at is queried from the source storage rather than a replica
+	if server.storages[0].count(STORAGE_PROTO_CMD_QUERY_FILE_INFO) != 2 || server.storages[1].count(STORAGE_PROTO_CMD_QUERY_FILE_INFO) != 0 {
+		t.Error("append should query the source storage.")
+		return
+	}
+	buff := new(bytes.Buffer)
+	if n, err := f.WriteTo(buff); err != nil || n != 7 || buff.String() != "012345A" {
+		t.Error("appender content invalid.", buff.String(), err)
+		return
+	}
+	//the size of an appender file is queried from the storage
+	if fetcher, err := f.Meta(); err != nil || fetcher.Fetch(SIZEKEY) != "7" {
+		t.Error("appender size invalid.", err)
+	}
+}
+
+func Test_StoreVariant(t *testing.T) {
+	server, err := newFakeFdfs(1, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+	s := server.storage(filepath.Join(t.TempDir(), "index"))
+	if _, err = s.StoreFile("img/1.jpg", []byte("master")); err != nil {
+		t.Error(err)
+		return
+	}
+	fileId, err := s.StoreVariant("img/1.jpg", "_150x150", "webp", []byte("variant"), KV{"width", "150"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasSuffix(fileId, "_150x150.webp") {
+		t.Error("variant file id invalid. fileId:", fileId)
+		return
+	}
+	f := s.File(s.VariantKey("img/1.jpg", "_150x150", "webp"))
+	if bts, _, err := f.Bytes(); err != nil || string(bts) != "variant" {
+		t.Error("variant content invalid.", err)
+		return
+	}
+	if fetcher, err := f.Meta(); err != nil || fetcher.Fetch("width") != "150" {
+		t.Error("variant meta invalid.", err)
+		return
+	}
+	if _, err = s.StoreVariant("img/2.jpg", "_s", "", []byte("variant")); !errors.Is(err, ErrNotFound) {
+		t.Error("variant of missing master should be not found. err:", err)
+		return
+	}
+	//storing the variant again replaces it, on the same master and on a replaced one
+	if _, err = s.StoreVariant("img/1.jpg", "_150x150", "webp", []byte("variant2")); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = s.StoreFile("img/1.jpg", []byte("master2")); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = s.StoreVariant("img/1.jpg", "_150x150", "webp", []byte("variant3")); err != nil {
+		t.Error(err)
+		return
+	}
+	if bts, _, err := f.Bytes(); err != nil || string(bts) != "variant3" {
+		t.Error("replaced variant content invalid.", string(bts), err)
+		return
+	}
+	//a variant is not the master of another one
+	if _, err = s.StoreVariant(s.VariantKey("img/1.jpg", "_150x150", "webp"), "_s", "", []byte("variant")); !errors.Is(err, ErrInvalidArgument) {
+		t.Error("variant of a variant should be invalid. err:", err)
+		return
+	}
+	//the uploaded slave is deleted if its meta can not be set
+	server.storages[0].inject(fault{}, fault{status: 28})
+	if _, err = s.StoreVariant("img/1.jpg", "_s", "", []byte("variant"), KV{"width", "150"}); !errors.Is(err, ErrNoSpace) {
+		t.Error("variant should fail with its meta. err:", err)
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.files) != 2 {
+		t.Error("only the master and its variant should be left.", len(server.files))
+	}
+}
+
+func Test_StoreReader(t *testing.T) {
+	server, err := newFakeFdfs(1, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+	s := server.storage("")
+	content := []byte(strings.Repeat("0123456789", streamChunkSize/2))
+	fileId, err := s.StoreReader("big.bin", bytes.NewReader(content), int64(len(content)), KV{"width", "150"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	buff := new(bytes.Buffer)
+	if n, err := s.File(fileId).(*file).WriteTo(buff); err != nil || n != int64(len(content)) || !bytes.Equal(buff.Bytes(), content) {
+		t.Error("streamed content invalid.", n, err)
+		return
+	}
+	//copy streams the file as well
+	copyId, err := s.Copy(fileId, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if f := server.file(copyId); f == nil || !bytes.Equal(f.data, content) {
+		t.Error("copied content invalid.")
+		return
+	}
+	//the meta of src is copied unless kvs replace it
+	if fetcher, err := s.File(copyId).Meta(); err != nil || fetcher.Fetch("width") != "150" {
+		t.Error("copied meta invalid.", err)
+		return
+	}
+	copyId, err = s.Copy(fileId, "", KV{"height", "100"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fetcher, err := s.File(copyId).Meta(); err != nil || fetcher.Fetch("width") != "" || fetcher.Fetch("height") != "100" {
+		t.Error("replaced meta invalid.", err)
+		return
+	}
+	if _, err = s.File(fileId).Delete(); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = s.Copy(fileId, ""); !errors.Is(err, ErrNotFound) {
+		t.Error("copy of missing file should be not found. err:", err)
+		return
+	}
+	//the reader is shorter than size
+	if _, err = s.StoreReader("short.bin", bytes.NewReader(content[:10]), 20); err == nil {
+		t.Error("short reader should fail.")
+	}
+}
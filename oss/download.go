@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/ctrip-nephele/aliyun-oss-go-sdk/oss"
+)
+
+// defaultDownloadPartSize is used when downloadRoutines is set without downloadPartSize.
+const defaultDownloadPartSize int64 = 8 << 20
+
+// downloadRetries is the number of attempts made for one range before giving up.
+const downloadRetries = 3
+
+// downloader splits large objects into ranges which are fetched concurrently,
+// the parallel mode is off unless routines is greater than 1.
+type downloader struct {
+	routines int
+	partSize int64
+}
+
+func newDownloader(config map[string]string) downloader {
+	d := downloader{partSize: defaultDownloadPartSize}
+	d.routines, _ = strconv.Atoi(config["downloadRoutines"])
+	if size, err := strconv.ParseInt(config["downloadPartSize"], 10, 64); err == nil && size > 0 {
+		d.partSize = size
+	}
+	return d
+}
+
+func (d downloader) parallel() bool {
+	return d.routines > 1
+}
+
+// download fetches the object of f in ranges of partSize with at most routines requests in flight.
+// The ranges are pinned to the etag of h, so an object replaced meanwhile fails with ErrPreconditionFailed.
+func (d downloader) download(f *file, h http.Header) ([]byte, error) {
+	size, err := strconv.ParseInt(h.Get(oss.HTTPHeaderContentLength), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	blob := make([]byte, size)
+	ranges := make(chan int64)
+	stop := make(chan struct{})
+	var once sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < d.routines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range ranges {
+				end := start + d.partSize
+				if end > size {
+					end = size
+				}
+				if e := d.fetch(f, h.Get(oss.HTTPHeaderEtag), blob[start:end], start); e != nil {
+					once.Do(func() {
+						err = e
+						close(stop)
+					})
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for start := int64(0); start < size; start += d.partSize {
+		select {
+		case ranges <- start:
+		case <-stop:
+			break feed
+		}
+	}
+	close(ranges)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return blob, checkCRC64(h, blob)
+}
+
+// fetch fills part with the range of the object starting at offset,
+// a broken range is resumed from the bytes already received.
+func (d downloader) fetch(f *file, etag string, part []byte, offset int64) error {
+	var err error
+	n := 0
+	for i := 0; i < downloadRetries && n < len(part); i++ {
+		options := append(f.versionOptions(),
+			oss.Range(offset+int64(n), offset+int64(len(part))-1),
+			oss.IfMatch(etag))
+		var r io.ReadCloser
+		r, _, err = f.bucket.GetObject(f.key, options...)
+		if err != nil {
+			if err = convertError(err); err == ErrPreconditionFailed || err == ErrNotRestored || errors.Is(err, ErrNotFound) {
+				return err
+			}
+			continue
+		}
+		var m int
+		m, err = io.ReadFull(r, part[n:])
+		r.Close()
+		n += m
+	}
+	if n < len(part) {
+		return err
+	}
+	return nil
+}
@@ -2,14 +2,44 @@ package main
 
 import (
 	"net/http"
+	"strings"
+
+	. "github.com/ctripcorp/nephele/storage"
 
 	"github.com/ctrip-nephele/aliyun-oss-go-sdk/oss"
 )
 
 type fetcher struct {
 	header http.Header
+	file   *file
+	// tags are loaded on the first fetch of TAGPREFIX
+	tags []KV
 }
 
+// Fetch returns the user meta of key, falling back to the response header
+// of the same name so that system values like ETag can be read as well.
 func (m *fetcher) Fetch(key string) string {
-	return m.header.Get(oss.HTTPHeaderOssMetaPrefix + key)
+	if strings.HasPrefix(key, TAGPREFIX) {
+		return m.tag(strings.TrimPrefix(key, TAGPREFIX))
+	}
+	if v := m.header.Get(oss.HTTPHeaderOssMetaPrefix + key); v != "" {
+		return v
+	}
+	return m.header.Get(key)
+}
+
+func (m *fetcher) tag(name string) string {
+	if m.tags == nil {
+		tags, err := m.file.Tags()
+		if err != nil {
+			return ""
+		}
+		m.tags = tags
+	}
+	for _, tag := range m.tags {
+		if tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
 }
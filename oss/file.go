@@ -2,55 +2,152 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	. "github.com/ctripcorp/nephele/storage"
+	"hash/crc64"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/ctrip-nephele/aliyun-oss-go-sdk/oss"
 )
 
+// reserved keys of KV, they are sent as request headers instead of user meta.
+// IFNONEMATCHKEY with value "*" stores the object only if it is absent.
+const IFMATCHKEY = oss.HTTPHeaderIfMatch
+const IFNONEMATCHKEY = oss.HTTPHeaderIfNoneMatch
+
+// reserved keys of KV to override the encryption and storage class configured in New.
+// Meta fetches the effective values by the same keys.
+const SSEKEY = oss.HTTPHeaderOssServerSideEncryption
+const SSEKEYIDKEY = oss.HTTPHeaderOssServerSideEncryptionKeyID
+const STORAGECLASSKEY = oss.HTTPHeaderOssStorageClass
+
+// RESTOREKEY fetches the restore status of an archived object from Meta,
+// e.g. ongoing-request="false", expiry-date="Sun, 16 Apr 2017 08:12:33 GMT".
+const RESTOREKEY = "X-Oss-Restore"
+
+// VERSIONIDKEY fetches the version id of the object from Meta.
+const VERSIONIDKEY = "X-Oss-Version-Id"
+
+// ETAGKEY, CRC64KEY and MD5KEY fetch the checksums of the object from Meta.
+const ETAGKEY = oss.HTTPHeaderEtag
+const CRC64KEY = oss.HTTPHeaderOssCRC64
+const MD5KEY = oss.HTTPHeaderContentMD5
+
+// SYMLINKTARGETKEY fetches the target key of a symlink object from Meta.
+const SYMLINKTARGETKEY = oss.HTTPHeaderOssSymlinkTarget
+
+// OBJECTTYPEKEY fetches the type of the object from Meta: Normal, Appendable, Multipart or Symlink.
+const OBJECTTYPEKEY = "X-Oss-Object-Type"
+
+// TAGGINGKEY is a reserved key of KV to tag the stored object,
+// its value is url encoded as "tenant=a&derived=true".
+const TAGGINGKEY = oss.HTTPHeaderOssTagging
+
+// TAGPREFIX fetches a tag from Meta, e.g. Fetch(TAGPREFIX + "tenant").
+const TAGPREFIX = "X-Oss-Tag-"
+
+// ErrNotFound matches the errors of missing objects by errors.Is,
+// convertError turns the 404 errors of oss into notFoundError which keeps the ServiceError.
+var ErrNotFound = os.ErrNotExist
+
+// ErrPreconditionFailed occurs when a conditional write does not match the stored object.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrNotRestored occurs when reading an archived object which is not restored yet,
+// call Restore and retry after Restored reports true.
+var ErrNotRestored = errors.New("archived object is not restored")
+
+// ErrCorrupted occurs when the crc64 computed locally differs from the one of oss,
+// it is wrapped with the two checksums and can be checked by errors.Is.
+var ErrCorrupted = errors.New("content is corrupted")
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
 type file struct {
-	bucket *oss.Bucket
-	key    string
-	blob   []byte
-	err    error
+	bucket   *oss.Bucket
+	defaults []KV
+	key      string
+	// versionId addresses a specific version, the latest one is used if empty
+	versionId string
+	// download fetches large objects in parallel ranges if enabled
+	download downloader
+	blob     []byte
+	err      error
 }
 
 func (f *file) Key() string {
 	return f.key
 }
 
+// VersionId returns the version addressed by the file, empty for the latest one.
+func (f *file) VersionId() string {
+	return f.versionId
+}
+
 func (f *file) Exist() (bool, string, error) {
-	return f.bucket.IsObjectExist(f.key)
+	return f.bucket.IsObjectExist(f.key, f.versionOptions()...)
 }
 
 func (f *file) Meta() (Fetcher, error) {
-	h, err := f.bucket.GetObjectDetailedMeta(f.key)
+	h, err := f.bucket.GetObjectDetailedMeta(f.key, f.versionOptions()...)
 	if err != nil {
-		return nil, err
+		return nil, convertError(err)
+	}
+	// oss answers the meta of the target for a symlink, its own target is fetched apart
+	if h.Get(OBJECTTYPEKEY) == "Symlink" {
+		target, err := f.Target()
+		if err != nil {
+			return nil, err
+		}
+		h.Set(SYMLINKTARGETKEY, target)
 	}
-	return &fetcher{h}, nil
+	return &fetcher{header: h, file: f}, nil
 }
 
 func (f *file) Append(blob []byte, index int64, kvs ...KV) (int64, string, error) {
-	options := make([]oss.Option, 0)
-	for _, kv := range kvs {
-		options = append(options, oss.Meta(kv[0], kv[1]))
+	// encryption and storage class are only accepted by the first append
+	if index == 0 {
+		kvs = withDefaults(f.defaults, kvs)
 	}
-	return f.bucket.AppendObject(f.key, bytes.NewReader(blob), index, options...)
+	return f.bucket.AppendObject(f.key, bytes.NewReader(blob), index, storeOptions(kvs)...)
 }
 
 func (f *file) Delete() (string, error) {
-	return f.bucket.DeleteObject(f.key)
+	return f.bucket.DeleteObject(f.key, f.versionOptions()...)
 }
 
 func (f *file) Bytes() ([]byte, string, error) {
-	r, rid, err := f.bucket.GetObject(f.key)
+	if f.download.parallel() {
+		h, err := f.bucket.GetObjectDetailedMeta(f.key, f.versionOptions()...)
+		if err != nil {
+			return nil, "", convertError(err)
+		}
+		if size, _ := strconv.ParseInt(h.Get(oss.HTTPHeaderContentLength), 10, 64); size > f.download.partSize {
+			b, err := f.download.download(f, h)
+			return b, h.Get(oss.HTTPHeaderOssRequestID), err
+		}
+	}
+	var h http.Header
+	options := append(f.versionOptions(), oss.GetResponseHeader(&h))
+	r, rid, err := f.bucket.GetObject(f.key, options...)
 	if err != nil {
-		return nil, "", err
+		return nil, "", convertError(err)
 	}
+	defer r.Close()
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
-		return nil, "", err
+		return nil, "", convertError(err)
+	}
+	if err = checkCRC64(h, b); err != nil {
+		return nil, rid, err
 	}
 	return b, rid, nil
 }
@@ -60,5 +157,205 @@ func (f *file) SetMeta(kvs ...KV) error {
 	for _, kv := range kvs {
 		options = append(options, oss.Meta(kv[0], kv[1]))
 	}
-	return f.bucket.SetObjectMeta(f.key, options...)
+	return convertError(f.bucket.SetObjectMeta(f.key, options...))
+}
+
+// IsSymlink reports whether the object is a symlink created by Storage.Symlink.
+func (f *file) IsSymlink() (bool, error) {
+	h, err := f.bucket.GetObjectDetailedMeta(f.key, f.versionOptions()...)
+	if err != nil {
+		return false, convertError(err)
+	}
+	return h.Get(OBJECTTYPEKEY) == "Symlink", nil
+}
+
+// Target returns the key which the symlink object points to.
+func (f *file) Target() (string, error) {
+	h, err := f.bucket.GetSymlink(f.key, f.versionOptions()...)
+	if err != nil {
+		return "", convertError(err)
+	}
+	return h.Get(SYMLINKTARGETKEY), nil
+}
+
+// SetTags replaces the tags of the object.
+func (f *file) SetTags(kvs ...KV) error {
+	tagging := oss.Tagging{Tags: make([]oss.Tag, 0, len(kvs))}
+	for _, kv := range kvs {
+		tagging.Tags = append(tagging.Tags, oss.Tag{Key: kv[0], Value: kv[1]})
+	}
+	return convertError(f.bucket.PutObjectTagging(f.key, tagging, f.versionOptions()...))
+}
+
+// Tags returns the tags of the object.
+func (f *file) Tags() ([]KV, error) {
+	r, err := f.bucket.GetObjectTagging(f.key, f.versionOptions()...)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	kvs := make([]KV, 0, len(r.Tags))
+	for _, tag := range r.Tags {
+		kvs = append(kvs, KV{tag.Key, tag.Value})
+	}
+	return kvs, nil
+}
+
+// Restore starts restoring an archived object, it is a no-op if a restore is in progress.
+func (f *file) Restore() (string, error) {
+	err := f.bucket.RestoreObject(f.key, f.versionOptions()...)
+	if e, ok := err.(oss.ServiceError); ok && e.Code == "RestoreAlreadyInProgress" {
+		return e.RequestID, nil
+	}
+	return "", convertError(err)
+}
+
+// Restored reports whether the object can be read, which is always true
+// for objects not in archive classes.
+func (f *file) Restored() (bool, error) {
+	h, err := f.bucket.GetObjectDetailedMeta(f.key, f.versionOptions()...)
+	if err != nil {
+		return false, convertError(err)
+	}
+	if !archived(h.Get(STORAGECLASSKEY)) {
+		return true, nil
+	}
+	return strings.Contains(h.Get(RESTOREKEY), "ongoing-request=\"false\""), nil
+}
+
+func archived(storageClass string) bool {
+	switch storageClass {
+	case "Archive", "ColdArchive", "DeepColdArchive":
+		return true
+	}
+	return false
+}
+
+func (f *file) versionOptions() []oss.Option {
+	if f.versionId == "" {
+		return nil
+	}
+	return []oss.Option{oss.VersionId(f.versionId)}
+}
+
+// checkCRC64 compares the crc64 in the response header of oss with the one of blob.
+// Objects stored before oss supported crc64 have no such header and pass.
+func checkCRC64(h http.Header, blob []byte) error {
+	expected := h.Get(CRC64KEY)
+	if expected == "" {
+		return nil
+	}
+	actual := strconv.FormatUint(crc64.Checksum(blob, crc64Table), 10)
+	if expected != actual {
+		return fmt.Errorf("%w: crc64 %s != %s", ErrCorrupted, actual, expected)
+	}
+	return nil
+}
+
+// tagging parses the url encoded value of TAGGINGKEY.
+func tagging(value string) oss.Tagging {
+	tagging := oss.Tagging{}
+	values, _ := url.ParseQuery(value)
+	for key := range values {
+		tagging.Tags = append(tagging.Tags, oss.Tag{Key: key, Value: values.Get(key)})
+	}
+	return tagging
+}
+
+// withDefaults returns kvs following the defaults, so that kvs take precedence.
+func withDefaults(defaults []KV, kvs []KV) []KV {
+	all := make([]KV, 0, len(defaults)+len(kvs))
+	all = append(all, defaults...)
+	return append(all, kvs...)
+}
+
+// md5Option sends the md5 of blob, so that oss rejects a body corrupted on the way.
+func md5Option(blob []byte) oss.Option {
+	sum := md5.Sum(blob)
+	return oss.ContentMD5(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// storeOptions converts kvs to put options, reserved keys become their headers.
+// The latter of duplicated reserved keys wins.
+func storeOptions(kvs []KV) []oss.Option {
+	options := make([]oss.Option, 0)
+	for _, kv := range kvs {
+		switch kv[0] {
+		case IFMATCHKEY:
+			options = append(options, oss.IfMatch(kv[1]))
+		case IFNONEMATCHKEY:
+			if kv[1] == "*" {
+				options = append(options, oss.ForbidOverWrite(true))
+			} else {
+				options = append(options, oss.IfNoneMatch(kv[1]))
+			}
+		case SSEKEY:
+			options = append(options, oss.ServerSideEncryption(kv[1]))
+		case SSEKEYIDKEY:
+			options = append(options, oss.ServerSideEncryptionKeyID(kv[1]))
+		case STORAGECLASSKEY:
+			options = append(options, oss.ObjectStorageClass(oss.StorageClassType(kv[1])))
+		case TAGGINGKEY:
+			options = append(options, oss.SetTagging(tagging(kv[1])))
+		default:
+			options = append(options, oss.Meta(kv[0], kv[1]))
+		}
+	}
+	return options
+}
+
+// hasMeta reports whether kvs have any user meta, that is a key storeOptions does not reserve.
+func hasMeta(kvs []KV) bool {
+	for _, kv := range kvs {
+		switch kv[0] {
+		case IFMATCHKEY, IFNONEMATCHKEY, SSEKEY, SSEKEYIDKEY, STORAGECLASSKEY, TAGGINGKEY:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// notFoundError keeps the service error of a missing object while matching ErrNotFound.
+type notFoundError struct {
+	oss.ServiceError
+}
+
+func (e notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+func (e notFoundError) Unwrap() error {
+	return e.ServiceError
+}
+
+// corruptedError keeps the crc error of the sdk while matching ErrCorrupted.
+type corruptedError struct {
+	oss.CRCCheckError
+}
+
+func (e corruptedError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+func (e corruptedError) Unwrap() error {
+	return e.CRCCheckError
+}
+
+// convertError maps oss service errors to the errors of this plugin.
+func convertError(err error) error {
+	if e, ok := err.(oss.CRCCheckError); ok {
+		return corruptedError{e}
+	}
+	if e, ok := err.(oss.ServiceError); ok {
+		if e.StatusCode == http.StatusNotFound {
+			return notFoundError{e}
+		}
+		if e.StatusCode == http.StatusPreconditionFailed || e.Code == "FileAlreadyExists" {
+			return ErrPreconditionFailed
+		}
+		if e.Code == "InvalidObjectState" {
+			return ErrNotRestored
+		}
+	}
+	return err
 }
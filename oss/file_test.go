@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/ctripcorp/nephele/storage"
+)
+
+func Test_File(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	f := s.File("1.txt").(*file)
+	blob := []byte("testest")
+	//1. append twice
+	next, _, e := f.Append(blob, 0, KV{"from", "test"})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if _, _, e = f.Append(blob, next); e != nil {
+		t.Error(e)
+		return
+	}
+	//2. check existence
+	exists, _, e := f.Exist()
+	if e != nil || !exists {
+		t.Error("file should exist. e:", e)
+		return
+	}
+	//3. get file
+	bts, _, e := f.Bytes()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if string(bts) != string(blob)+string(blob) {
+		t.Error("get content invalid.")
+		return
+	}
+	//4. meta
+	if e = f.SetMeta(KV{"from", "meta"}); e != nil {
+		t.Error(e)
+		return
+	}
+	m, e := f.Meta()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if m.Fetch("from") != "meta" || m.Fetch(CRC64KEY) != crc64Of(bts) {
+		t.Error("get meta invalid.")
+		return
+	}
+	//5. delete file
+	if _, e = f.Delete(); e != nil {
+		t.Error(e)
+		return
+	}
+	if exists, _, e = f.Exist(); e != nil || exists {
+		t.Error("file should not exist. e:", e)
+		return
+	}
+}
+
+func Test_ConditionalWrite(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	//1. create only if absent
+	if _, e := s.StoreFile("1.txt", []byte("1"), KV{IFNONEMATCHKEY, "*"}); e != nil {
+		t.Error(e)
+		return
+	}
+	if _, e := s.StoreFile("1.txt", []byte("2"), KV{IFNONEMATCHKEY, "*"}); e != ErrPreconditionFailed {
+		t.Error("create twice should fail. e:", e)
+		return
+	}
+	//2. replace only if etag matches
+	m, e := s.File("1.txt").Meta()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	tag := m.Fetch(ETAGKEY)
+	if _, e = s.StoreFile("1.txt", []byte("3"), KV{IFMATCHKEY, tag}); e != nil {
+		t.Error(e)
+		return
+	}
+	if _, e = s.StoreFile("1.txt", []byte("4"), KV{IFMATCHKEY, tag}); e != ErrPreconditionFailed {
+		t.Error("stale etag should fail. e:", e)
+		return
+	}
+}
+
+func Test_Faults(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	if e := storeFiles(s, "1.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	f := s.File("1.txt")
+	//1. server error
+	server.inject(fault{status: 503})
+	if _, _, e := f.Bytes(); e == nil {
+		t.Error("server error should fail.")
+		return
+	}
+	//2. slow response
+	server.inject(fault{delay: 100 * time.Millisecond})
+	if _, _, e := f.Bytes(); e != nil {
+		t.Error(e)
+		return
+	}
+	//3. truncated body
+	server.inject(fault{truncate: true})
+	if _, _, e := f.Bytes(); e == nil {
+		t.Error("truncated body should fail.")
+		return
+	}
+	//4. corrupted body
+	server.inject(fault{corrupt: true})
+	if _, _, e := f.Bytes(); !errors.Is(e, ErrCorrupted) {
+		t.Error("corrupted body should fail. e:", e)
+		return
+	}
+	//5. missing object
+	if _, _, e := s.File("absent.txt").Bytes(); !errors.Is(e, ErrNotFound) {
+		t.Error("missing object should be not found. e:", e)
+		return
+	}
+	if _, e := s.File("absent.txt").Meta(); !errors.Is(e, ErrNotFound) {
+		t.Error("meta of missing object should be not found. e:", e)
+		return
+	}
+	//6. corrupted upload
+	server.inject(fault{corruptUpload: true})
+	if _, e := s.StoreFile("2.txt", []byte("2")); !errors.Is(e, ErrCorrupted) {
+		t.Error("corrupted upload should fail. e:", e)
+		return
+	}
+}
+
+func Test_Signature(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := New(map[string]string{
+		"endpoint":        server.URL,
+		"bucketname":      fakeBucket,
+		"accessKeyId":     fakeAccessKeyId,
+		"accessKeySecret": "invalid",
+	}).(*storage)
+	if _, e := s.StoreFile("1.txt", []byte("1")); e == nil {
+		t.Error("invalid signature should fail.")
+		return
+	}
+	server.checkSign = false
+	if _, e := s.StoreFile("1.txt", []byte("1")); e != nil {
+		t.Error(e)
+		return
+	}
+}
+
+func Test_Tags(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	if _, e := s.StoreFile("1.txt", []byte("1"), KV{TAGGINGKEY, "tenant=a"}); e != nil {
+		t.Error(e)
+		return
+	}
+	f := s.File("1.txt").(*file)
+	if e := f.SetTags(KV{"tenant", "b"}, KV{"derived", "true"}); e != nil {
+		t.Error(e)
+		return
+	}
+	m, e := f.Meta()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if m.Fetch(TAGPREFIX+"tenant") != "b" || m.Fetch(TAGPREFIX+"derived") != "true" {
+		t.Error("get tags invalid.")
+		return
+	}
+}
+
+func Test_Symlink(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	if e := storeFiles(s, "hash.jpg"); e != nil {
+		t.Error(e)
+		return
+	}
+	if _, e := s.Symlink("alias.jpg", "hash.jpg"); e != nil {
+		t.Error(e)
+		return
+	}
+	f := s.File("alias.jpg").(*file)
+	if symlink, e := f.IsSymlink(); e != nil || !symlink {
+		t.Error("file should be a symlink. e:", e)
+		return
+	}
+	bts, _, e := f.Bytes()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if string(bts) != "hash.jpg" {
+		t.Error("get content invalid.")
+		return
+	}
+	m, e := f.Meta()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if m.Fetch(SYMLINKTARGETKEY) != "hash.jpg" {
+		t.Error("get target invalid.")
+		return
+	}
+	//errors of the symlink are converted
+	server.inject(fault{status: 404})
+	if _, e := s.Symlink("alias.jpg", "hash.jpg"); !errors.Is(e, ErrNotFound) {
+		t.Error("symlink error should be converted. e:", e)
+	}
+}
+
+func Test_ParallelBytes(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	s.download = downloader{routines: 4, partSize: 10}
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 6)
+	if _, e := s.StoreFile("1.txt", blob); e != nil {
+		t.Error(e)
+		return
+	}
+	f := s.File("1.txt")
+	//1. ranges reassembled in order
+	bts, _, e := f.Bytes()
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if !bytes.Equal(bts, blob) {
+		t.Error("get content invalid.")
+		return
+	}
+	//2. failed and truncated ranges are resumed
+	server.inject(fault{}, fault{status: 503}, fault{truncate: true})
+	if bts, _, e = f.Bytes(); e != nil {
+		t.Error(e)
+		return
+	}
+	if !bytes.Equal(bts, blob) {
+		t.Error("get content invalid after resume.")
+		return
+	}
+	//3. corrupted range
+	server.inject(fault{}, fault{corrupt: true})
+	if _, _, e = f.Bytes(); !errors.Is(e, ErrCorrupted) {
+		t.Error("corrupted range should fail. e:", e)
+		return
+	}
+	//4. small objects are fetched in one request
+	if _, e = s.StoreFile("2.txt", blob[:10]); e != nil {
+		t.Error(e)
+		return
+	}
+	if bts, _, e = s.File("2.txt").Bytes(); e != nil || !bytes.Equal(bts, blob[:10]) {
+		t.Error("get small content failed.", e)
+		return
+	}
+}
+
+func Test_Restore(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	if _, e := s.StoreFile("1.txt", []byte("1"), KV{STORAGECLASSKEY, "Archive"}); e != nil {
+		t.Error(e)
+		return
+	}
+	f := s.File("1.txt").(*file)
+	//1. an archived object can not be read before restored
+	if _, _, e := f.Bytes(); e != ErrNotRestored {
+		t.Error("read before restore should fail. e:", e)
+		return
+	}
+	if restored, e := f.Restored(); e != nil || restored {
+		t.Error("object should not be restored.", e)
+		return
+	}
+	//2. restore again while in progress is a no-op
+	for i := 0; i < 2; i++ {
+		if _, e := f.Restore(); e != nil {
+			t.Error(e)
+			return
+		}
+	}
+	if restored, e := f.Restored(); e != nil || restored {
+		t.Error("object should be restoring.", e)
+		return
+	}
+	//3. readable after restored
+	server.restored("1.txt")
+	if restored, e := f.Restored(); e != nil || !restored {
+		t.Error("object should be restored.", e)
+		return
+	}
+	if bts, _, e := f.Bytes(); e != nil || string(bts) != "1" {
+		t.Error("read after restore invalid. e:", e)
+		return
+	}
+	//4. objects not in archive classes are always readable
+	if e := storeFiles(s, "2.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	if restored, e := s.File("2.txt").(*file).Restored(); e != nil || !restored {
+		t.Error("standard object should be restored.", e)
+		return
+	}
+	if _, e := s.File("missing").(*file).Restore(); !errors.Is(e, ErrNotFound) {
+		t.Error("restore of missing object should be not found. e:", e)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strings"
+	"sync"
 	"time"
 
 	. "github.com/ctripcorp/nephele/storage"
@@ -8,15 +10,31 @@ import (
 	"github.com/ctrip-nephele/aliyun-oss-go-sdk/oss"
 )
 
+// VERSIONSEP separates the key and the version id in the LastKey of a version iterator.
+const VERSIONSEP = "?versionId="
+
 type iterator struct {
-	bucket          *oss.Bucket
-	prefix, lastKey string
-	files           chan *file
+	bucket *oss.Bucket
+	prefix string
+	// versions iterates over ListObjectVersions instead of ListObjects
+	versions bool
+	files    chan *file
+
+	// mutex guards the position of the last file returned by Next, which the listing
+	// starts from and runs ahead of by the buffer of files
+	mutex                  sync.Mutex
+	lastKey, lastVersionId string
 }
 
 func (iter *iterator) syncing() {
+	if iter.versions {
+		iter.syncingVersions()
+		return
+	}
+	// no file is returned by Next before the first one is sent, so lastKey is not changed yet
+	marker := iter.lastKey
 	for {
-		r, err := iter.bucket.ListObjects(oss.Marker(iter.lastKey), oss.Prefix(iter.prefix))
+		r, err := iter.bucket.ListObjects(oss.Marker(marker), oss.Prefix(iter.prefix))
 		if err != nil {
 			iter.files <- &file{
 				err: err,
@@ -34,19 +52,110 @@ func (iter *iterator) syncing() {
 				bucket: iter.bucket,
 				key:    object.Key,
 			}
-			iter.lastKey = object.Key
+			marker = object.Key
+		}
+	}
+}
+
+func (iter *iterator) syncingVersions() {
+	keyMarker, versionIdMarker := iter.lastKey, iter.lastVersionId
+	for {
+		r, err := iter.bucket.ListObjectVersions(oss.KeyMarker(keyMarker),
+			oss.VersionIdMarker(versionIdMarker), oss.Prefix(iter.prefix))
+		if err != nil {
+			iter.files <- &file{
+				err: err,
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if len(r.ObjectVersions) == 0 && !r.IsTruncated {
+			iter.files <- nil
+			time.Sleep(time.Second)
+			continue
+		}
+		// delete markers are skipped, they have no content to read
+		for _, version := range r.ObjectVersions {
+			iter.files <- &file{
+				bucket:    iter.bucket,
+				key:       version.Key,
+				versionId: version.VersionId,
+			}
+			keyMarker, versionIdMarker = version.Key, version.VersionId
+		}
+		if r.IsTruncated {
+			keyMarker, versionIdMarker = r.NextKeyMarker, r.NextVersionIdMarker
 		}
 	}
 }
 
 func (iter *iterator) Next() (File, error) {
 	f := <-iter.files
+	// nil is sent when every object has been listed
+	if f == nil {
+		return nil, nil
+	}
 	if f.err != nil {
 		return nil, f.err
 	}
+	iter.mutex.Lock()
+	defer iter.mutex.Unlock()
+	iter.lastKey, iter.lastVersionId = f.key, f.versionId
 	return f, nil
 }
 
+// LastKey is the position of the last file returned by Next.
 func (iter *iterator) LastKey() string {
+	iter.mutex.Lock()
+	defer iter.mutex.Unlock()
+	if iter.versions && iter.lastVersionId != "" {
+		return iter.lastKey + VERSIONSEP + iter.lastVersionId
+	}
 	return iter.lastKey
 }
+
+// splitVersion splits the LastKey of a version iterator to key and version id.
+func splitVersion(lastKey string) (string, string) {
+	if i := strings.LastIndex(lastKey, VERSIONSEP); i != -1 {
+		return lastKey[:i], lastKey[i+len(VERSIONSEP):]
+	}
+	return lastKey, ""
+}
+
+// taggedIterator skips the files which do not have all of tags.
+type taggedIterator struct {
+	*iterator
+	tags []KV
+}
+
+func (iter *taggedIterator) Next() (File, error) {
+	for {
+		f, err := iter.iterator.Next()
+		if f == nil || err != nil {
+			return f, err
+		}
+		tags, err := f.(*file).Tags()
+		if err != nil {
+			return nil, err
+		}
+		if hasTags(tags, iter.tags) {
+			return f, nil
+		}
+	}
+}
+
+func hasTags(tags []KV, wanted []KV) bool {
+	for _, w := range wanted {
+		found := false
+		for _, tag := range tags {
+			if tag == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
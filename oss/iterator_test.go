@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/ctripcorp/nephele/storage"
+)
+
+func Test_Iterator(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	if e := storeFiles(s, "a/1.txt", "a/2.txt", "a/3.txt", "b/1.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	iter := s.Iterator("a/", "a/1.txt")
+	for _, key := range []string{"a/2.txt", "a/3.txt"} {
+		f, e := iter.Next()
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		if f.Key() != key {
+			t.Error("next file invalid. key:", f.Key())
+			return
+		}
+	}
+	if f, e := iter.Next(); f != nil || e != nil {
+		t.Error("no more files expected.", f, e)
+		return
+	}
+	if iter.LastKey() != "a/3.txt" {
+		t.Error("last key invalid. key:", iter.LastKey())
+		return
+	}
+}
+
+func Test_TaggedIterator(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	for key, tags := range map[string]string{"1.txt": "tenant=a", "2.txt": "tenant=b", "3.txt": "tenant=a&derived=true"} {
+		if _, e := s.StoreFile(key, []byte(key), KV{TAGGINGKEY, tags}); e != nil {
+			t.Error(e)
+			return
+		}
+	}
+	iter := s.TaggedIterator("", "", KV{"tenant", "a"})
+	for _, key := range []string{"1.txt", "3.txt"} {
+		f, e := iter.Next()
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		if f.Key() != key {
+			t.Error("next file invalid. key:", f.Key())
+			return
+		}
+	}
+}
+
+func Test_VersionIterator(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	server.versioning = true
+	s := server.storage()
+	versions := make([]string, 0)
+	for _, content := range []string{"v1", "v2", "v3"} {
+		versionId, e := s.StoreFile("a/1.txt", []byte(content))
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		versions = append(versions, versionId)
+	}
+	if e := storeFiles(s, "a/2.txt", "b/1.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	//1. every version of the prefix, the newest first
+	iter := s.VersionIterator("a/", "")
+	for _, content := range []string{"v3", "v2", "v1", "a/2.txt"} {
+		f, e := iter.Next()
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		if bts, _, e := f.Bytes(); e != nil || string(bts) != content {
+			t.Error("version content invalid. key:", f.Key(), "versionId:", f.(*file).VersionId(), e)
+			return
+		}
+	}
+	if f, e := iter.Next(); f != nil || e != nil {
+		t.Error("no more versions expected.", f, e)
+		return
+	}
+	if !strings.HasPrefix(iter.LastKey(), "a/2.txt"+VERSIONSEP) {
+		t.Error("last key invalid. key:", iter.LastKey())
+		return
+	}
+	//2. resume from the LastKey of a version
+	iter = s.VersionIterator("a/", "a/1.txt"+VERSIONSEP+versions[2])
+	f, e := iter.Next()
+	if e != nil || f == nil || f.(*file).VersionId() != versions[1] {
+		t.Error("resumed version invalid.", f, e)
+		return
+	}
+	//the listing runs ahead, but LastKey stays at the file returned
+	if iter.LastKey() != "a/1.txt"+VERSIONSEP+versions[1] {
+		t.Error("last key should be the returned version. key:", iter.LastKey())
+		return
+	}
+	//3. a version is read by its id
+	if bts, _, e := s.Version("a/1.txt", versions[0]).Bytes(); e != nil || string(bts) != "v1" {
+		t.Error("get version invalid.", e)
+	}
+}
@@ -29,7 +29,20 @@ func New(config map[string]string) Storage {
 		return nil
 	}
 
+	defaults := make([]KV, 0)
+	for key, name := range map[string]string{
+		SSEKEY:          "serverSideEncryption",
+		SSEKEYIDKEY:     "serverSideEncryptionKeyId",
+		STORAGECLASSKEY: "storageClass",
+	} {
+		if config[name] != "" {
+			defaults = append(defaults, KV{key, config[name]})
+		}
+	}
+
 	return &storage{
-		bucket: bucket,
+		bucket:   bucket,
+		defaults: defaults,
+		download: newDownloader(config),
 	}
 }
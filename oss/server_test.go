@@ -0,0 +1,786 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctrip-nephele/aliyun-oss-go-sdk/oss"
+)
+
+const (
+	fakeBucket          = "bucket"
+	fakeAccessKeyId     = "accessKeyId"
+	fakeAccessKeySecret = "accessKeySecret"
+)
+
+// signedParams are the sub resources included in the v1 signature.
+var signedParams = map[string]bool{
+	"acl": true, "append": true, "delete": true, "objectMeta": true,
+	"partNumber": true, "position": true, "restore": true, "symlink": true,
+	"tagging": true, "uploadId": true, "uploads": true, "versionId": true,
+	"versions": true,
+}
+
+// fault is injected into the next request served by fakeOSS.
+type fault struct {
+	// status replies with the status code instead of serving the request
+	status int
+	// delay sleeps before serving the request
+	delay time.Duration
+	// truncate cuts the response body in half while keeping its Content-Length
+	truncate bool
+	// corrupt flips the first byte of the response body
+	corrupt bool
+	// corruptUpload flips the first byte of the request body behind its Content-MD5 check,
+	// so only the crc64 of the response tells
+	corruptUpload bool
+}
+
+type fakeObject struct {
+	data       []byte
+	header     http.Header
+	tags       url.Values
+	appendable bool
+	modified   time.Time
+	// target is the key pointed to by a symlink object
+	target string
+	// versionId is set if the object is stored with versioning enabled
+	versionId string
+	// restore is the X-Oss-Restore header of an archived object, empty if never restored
+	restore string
+}
+
+type fakeUpload struct {
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+// fakeOSS emulates the object api of one oss bucket over http.
+type fakeOSS struct {
+	*httptest.Server
+	// checkSign rejects the requests whose v1 signature does not match
+	checkSign bool
+	// versioning keeps the overwritten and deleted objects as noncurrent versions
+	versioning bool
+
+	mutex   sync.Mutex
+	objects map[string]*fakeObject
+	// versions are the noncurrent versions of keys, the newest first
+	versions map[string][]*fakeObject
+	uploads  map[string]*fakeUpload
+	faults   []fault
+	seq      int
+}
+
+func newFakeOSS() *fakeOSS {
+	s := &fakeOSS{
+		checkSign: true,
+		objects:   make(map[string]*fakeObject),
+		versions:  make(map[string][]*fakeObject),
+		uploads:   make(map[string]*fakeUpload),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// storage returns the plugin connected to the fake server.
+func (s *fakeOSS) storage() *storage {
+	return New(map[string]string{
+		"endpoint":        s.URL,
+		"bucketname":      fakeBucket,
+		"accessKeyId":     fakeAccessKeyId,
+		"accessKeySecret": fakeAccessKeySecret,
+	}).(*storage)
+}
+
+// restored completes the restore of an archived object.
+func (s *fakeOSS) restored(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if o, ok := s.objects[key]; ok {
+		o.restore = `ongoing-request="false", expiry-date="` + time.Now().Add(24*time.Hour).UTC().Format(http.TimeFormat) + `"`
+	}
+}
+
+// inject queues faults for the following requests.
+func (s *fakeOSS) inject(faults ...fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append(s.faults, faults...)
+}
+
+func (s *fakeOSS) nextFault() fault {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.faults) == 0 {
+		return fault{}
+	}
+	f := s.faults[0]
+	s.faults = s.faults[1:]
+	return f
+}
+
+func (s *fakeOSS) nextId() string {
+	s.seq++
+	return strconv.Itoa(s.seq)
+}
+
+func (s *fakeOSS) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(oss.HTTPHeaderOssRequestID, fmt.Sprintf("%d", time.Now().UnixNano()))
+	f := s.nextFault()
+	time.Sleep(f.delay)
+	if f.status != 0 {
+		replyError(w, f.status, "InternalError", "injected fault")
+		return
+	}
+	if s.checkSign && r.Header.Get(oss.HTTPHeaderAuthorization) != sign(r) {
+		replyError(w, http.StatusForbidden, "SignatureDoesNotMatch", "signature does not match")
+		return
+	}
+	if f.corruptUpload {
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) > 0 {
+			body[0] ^= 0xff
+		}
+		r.Header.Del(oss.HTTPHeaderContentMD5)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != fakeBucket {
+		replyError(w, http.StatusNotFound, "NoSuchBucket", "bucket does not exist")
+		return
+	}
+	key := ""
+	if len(path) == 2 {
+		key = path[1]
+	}
+	if f.truncate || f.corrupt {
+		rec := httptest.NewRecorder()
+		s.route(rec, r, key)
+		body := rec.Body.Bytes()
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.Header().Set(oss.HTTPHeaderContentLength, strconv.Itoa(len(body)))
+		if f.corrupt && len(body) > 0 {
+			body[0] ^= 0xff
+		}
+		w.WriteHeader(rec.Code)
+		if f.truncate {
+			body = body[:len(body)/2]
+		}
+		w.Write(body)
+		return
+	}
+	s.route(w, r, key)
+}
+
+func (s *fakeOSS) route(w http.ResponseWriter, r *http.Request, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	_, tagging := q["tagging"]
+	_, symlink := q["symlink"]
+	_, versions := q["versions"]
+	_, restore := q["restore"]
+	switch {
+	case r.Method == http.MethodGet && key == "" && versions:
+		s.listObjectVersions(w, q)
+	case r.Method == http.MethodGet && key == "":
+		s.listObjects(w, q)
+	case r.Method == http.MethodPost && key == "":
+		s.deleteObjects(w, r)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		s.uploadPart(w, r, key)
+	case r.Method == http.MethodPut && tagging:
+		s.putTagging(w, r, key)
+	case r.Method == http.MethodPut && symlink:
+		s.putSymlink(w, r, key)
+	case r.Method == http.MethodPut && r.Header.Get(oss.HTTPHeaderOssCopySource) != "":
+		s.copyObject(w, r, key)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, key)
+	case r.Method == http.MethodPost && uploads:
+		s.initiateUpload(w, r, key)
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		s.completeUpload(w, r, key)
+	case r.Method == http.MethodPost && q.Get("position") != "":
+		s.appendObject(w, r, key)
+	case r.Method == http.MethodPost && restore:
+		s.restoreObject(w, key)
+	case r.Method == http.MethodGet && tagging:
+		s.getTagging(w, key)
+	case r.Method == http.MethodGet && symlink:
+		s.getSymlink(w, key)
+	case r.Method == http.MethodGet:
+		s.getObject(w, r, key)
+	case r.Method == http.MethodHead:
+		s.headObject(w, r, key)
+	case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		s.deleteObject(key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		replyError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String())
+	}
+}
+
+func (s *fakeOSS) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	data, _ := ioutil.ReadAll(r.Body)
+	if md5 := r.Header.Get(oss.HTTPHeaderContentMD5); md5 != "" && md5 != contentMD5(data) {
+		replyError(w, http.StatusBadRequest, "InvalidDigest", "content md5 does not match")
+		return
+	}
+	if !s.writable(w, r, key) {
+		return
+	}
+	s.store(w, r, key, data, false)
+}
+
+func (s *fakeOSS) appendObject(w http.ResponseWriter, r *http.Request, key string) {
+	data, _ := ioutil.ReadAll(r.Body)
+	position, _ := strconv.ParseInt(r.URL.Query().Get("position"), 10, 64)
+	o, ok := s.objects[key]
+	switch {
+	case ok && !o.appendable:
+		replyError(w, http.StatusConflict, "ObjectNotAppendable", "object is not appendable")
+		return
+	case !ok && position != 0, ok && int64(len(o.data)) != position:
+		w.Header().Set(oss.HTTPHeaderOssNextAppendPosition, strconv.Itoa(len(s.content(key))))
+		replyError(w, http.StatusConflict, "PositionNotEqualToLength", "position is not equal to length")
+		return
+	}
+	if ok {
+		data = append(o.data, data...)
+		o.data = data
+		o.modified = time.Now()
+		w.Header().Set(oss.HTTPHeaderOssCRC64, crc64Of(data))
+	} else {
+		s.store(w, r, key, data, true)
+	}
+	w.Header().Set(oss.HTTPHeaderOssNextAppendPosition, strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *fakeOSS) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	src, ok := s.source(w, r)
+	if !ok || !s.writable(w, r, key) {
+		return
+	}
+	header := cloneHeader(r.Header)
+	if r.Header.Get(oss.HTTPHeaderOssMetadataDirective) != string(oss.MetaReplace) {
+		// the encryption and storage class of the request apply to dst either way
+		header = cloneHeader(src.header)
+		for _, k := range []string{oss.HTTPHeaderOssStorageClass, oss.HTTPHeaderOssServerSideEncryption, oss.HTTPHeaderOssServerSideEncryptionKeyID} {
+			if v := r.Header.Get(k); v != "" {
+				header.Set(k, v)
+			}
+		}
+	}
+	s.store(w, r, key, append([]byte(nil), src.data...), false)
+	s.objects[key].header = header
+	replyXML(w, oss.CopyObjectResult{LastModified: time.Now(), ETag: etagOf(src.data)})
+}
+
+func (s *fakeOSS) initiateUpload(w http.ResponseWriter, r *http.Request, key string) {
+	id := s.nextId()
+	s.uploads[id] = &fakeUpload{key: key, header: cloneHeader(r.Header), parts: make(map[int][]byte)}
+	replyXML(w, oss.InitiateMultipartUploadResult{Bucket: fakeBucket, Key: key, UploadID: id})
+}
+
+func (s *fakeOSS) uploadPart(w http.ResponseWriter, r *http.Request, key string) {
+	u, ok := s.uploads[r.URL.Query().Get("uploadId")]
+	if !ok {
+		replyError(w, http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+		return
+	}
+	number, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if r.Header.Get(oss.HTTPHeaderOssCopySource) == "" {
+		data, _ := ioutil.ReadAll(r.Body)
+		u.parts[number] = data
+		w.Header().Set(oss.HTTPHeaderEtag, etagOf(data))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	src, ok := s.source(w, r)
+	if !ok {
+		return
+	}
+	var start, end int
+	fmt.Sscanf(r.Header.Get(oss.HTTPHeaderOssCopySourceRange), "bytes=%d-%d", &start, &end)
+	if end >= len(src.data) {
+		end = len(src.data) - 1
+	}
+	u.parts[number] = append([]byte(nil), src.data[start:end+1]...)
+	replyXML(w, oss.UploadPartCopyResult{LastModified: time.Now(), ETag: etagOf(u.parts[number])})
+}
+
+func (s *fakeOSS) completeUpload(w http.ResponseWriter, r *http.Request, key string) {
+	id := r.URL.Query().Get("uploadId")
+	u, ok := s.uploads[id]
+	if !ok {
+		replyError(w, http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+		return
+	}
+	var complete struct {
+		Parts []oss.UploadPart `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+		replyError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	data := make([]byte, 0)
+	for _, part := range complete.Parts {
+		data = append(data, u.parts[part.PartNumber]...)
+	}
+	delete(s.uploads, id)
+	s.store(w, r, key, data, false)
+	s.objects[key].header = u.header
+	replyXML(w, oss.CompleteMultipartUploadResult{Bucket: fakeBucket, Key: key, ETag: etagOf(data)})
+}
+
+func (s *fakeOSS) putSymlink(w http.ResponseWriter, r *http.Request, key string) {
+	target, _ := url.QueryUnescape(r.Header.Get(oss.HTTPHeaderOssSymlinkTarget))
+	s.objects[key] = &fakeObject{header: cloneHeader(r.Header), tags: url.Values{},
+		modified: time.Now(), target: target}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *fakeOSS) getSymlink(w http.ResponseWriter, key string) {
+	o, ok := s.objects[key]
+	if !ok || o.target == "" {
+		replyError(w, http.StatusNotFound, "NoSuchKey", "symlink does not exist")
+		return
+	}
+	w.Header().Set(oss.HTTPHeaderOssSymlinkTarget, url.QueryEscape(o.target))
+	w.WriteHeader(http.StatusOK)
+}
+
+// resolve follows the symlink of key, reads of a symlink return its target.
+func (s *fakeOSS) resolve(key string) string {
+	if o, ok := s.objects[key]; ok && o.target != "" {
+		return o.target
+	}
+	return key
+}
+
+// object finds the version of key, the current one if versionId is empty.
+func (s *fakeOSS) object(key, versionId string) (*fakeObject, bool) {
+	o, ok := s.objects[key]
+	if versionId == "" || ok && o.versionId == versionId {
+		return o, ok
+	}
+	for _, o := range s.versions[key] {
+		if o.versionId == versionId {
+			return o, true
+		}
+	}
+	return nil, false
+}
+
+func (s *fakeOSS) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	key = s.resolve(key)
+	o, ok := s.object(key, r.URL.Query().Get("versionId"))
+	if !ok {
+		replyError(w, http.StatusNotFound, "NoSuchKey", "object does not exist")
+		return
+	}
+	if match := r.Header.Get(oss.HTTPHeaderIfMatch); match != "" && match != etagOf(o.data) {
+		replyError(w, http.StatusPreconditionFailed, "PreconditionFailed", "etag does not match")
+		return
+	}
+	if archived(storageClassOf(o.header)) && !strings.Contains(o.restore, `ongoing-request="false"`) {
+		replyError(w, http.StatusForbidden, "InvalidObjectState", "object is archived")
+		return
+	}
+	s.writeMeta(w, o)
+	data := o.data
+	status := http.StatusOK
+	var start, end int
+	if n, _ := fmt.Sscanf(r.Header.Get(oss.HTTPHeaderRange), "bytes=%d-%d", &start, &end); n == 2 {
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set(oss.HTTPHeaderContentLength, strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (s *fakeOSS) headObject(w http.ResponseWriter, r *http.Request, key string) {
+	o, ok := s.object(s.resolve(key), r.URL.Query().Get("versionId"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.writeMeta(w, o)
+	if key != s.resolve(key) {
+		w.Header().Set("X-Oss-Object-Type", "Symlink")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *fakeOSS) listObjects(w http.ResponseWriter, q url.Values) {
+	prefix, marker := q.Get("prefix"), q.Get("marker")
+	maxKeys, _ := strconv.Atoi(q.Get("max-keys"))
+	if maxKeys <= 0 {
+		maxKeys = 100
+	}
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	r := oss.ListObjectsResult{Prefix: prefix, Marker: marker, MaxKeys: maxKeys}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		r.IsTruncated = true
+		r.NextMarker = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		o := s.objects[key]
+		r.Objects = append(r.Objects, oss.ObjectProperties{
+			Key:          key,
+			Size:         int64(len(o.data)),
+			ETag:         etagOf(o.data),
+			LastModified: o.modified,
+			StorageClass: storageClassOf(o.header),
+		})
+	}
+	replyXML(w, r)
+}
+
+func (s *fakeOSS) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Objects []oss.DeleteObject `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		replyError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	var result oss.DeleteObjectVersionsResult
+	for _, object := range request.Objects {
+		s.deleteObject(object.Key)
+		result.DeletedObjectsDetail = append(result.DeletedObjectsDetail, oss.DeletedKeyInfo{Key: object.Key})
+	}
+	replyXML(w, result)
+}
+
+// deleteObject removes the current object of key, it is kept as a noncurrent version if versioning.
+func (s *fakeOSS) deleteObject(key string) {
+	if o, ok := s.objects[key]; ok && s.versioning {
+		s.versions[key] = append([]*fakeObject{o}, s.versions[key]...)
+	}
+	delete(s.objects, key)
+}
+
+func (s *fakeOSS) restoreObject(w http.ResponseWriter, key string) {
+	o, ok := s.objects[key]
+	switch {
+	case !ok:
+		replyError(w, http.StatusNotFound, "NoSuchKey", "object does not exist")
+	case !archived(storageClassOf(o.header)):
+		replyError(w, http.StatusBadRequest, "OperationNotSupported", "object is not archived")
+	case o.restore == `ongoing-request="true"`:
+		replyError(w, http.StatusConflict, "RestoreAlreadyInProgress", "object is being restored")
+	case o.restore == "":
+		o.restore = `ongoing-request="true"`
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// listObjectVersions lists the versions of the keys in order, the newest first for each key,
+// and skips the ones up to the key and version id markers.
+func (s *fakeOSS) listObjectVersions(w http.ResponseWriter, q url.Values) {
+	prefix, keyMarker, versionMarker := q.Get("prefix"), q.Get("key-marker"), q.Get("version-id-marker")
+	maxKeys, _ := strconv.Atoi(q.Get("max-keys"))
+	if maxKeys <= 0 {
+		maxKeys = 100
+	}
+	keys := make([]string, 0, len(s.objects)+len(s.versions))
+	for key := range s.versions {
+		keys = append(keys, key)
+	}
+	for key := range s.objects {
+		if _, ok := s.versions[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	r := oss.ListObjectVersionsResult{Prefix: prefix, KeyMarker: keyMarker, VersionIdMarker: versionMarker, MaxKeys: maxKeys}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key < keyMarker || key == keyMarker && versionMarker == "" {
+			continue
+		}
+		versions := s.versions[key]
+		if o, ok := s.objects[key]; ok {
+			versions = append([]*fakeObject{o}, versions...)
+		}
+		for _, o := range versions {
+			if key == keyMarker {
+				if o.versionId == versionMarker {
+					keyMarker = ""
+				}
+				continue
+			}
+			if len(r.ObjectVersions) == maxKeys {
+				r.IsTruncated = true
+				last := r.ObjectVersions[maxKeys-1]
+				r.NextKeyMarker, r.NextVersionIdMarker = last.Key, last.VersionId
+				replyXML(w, r)
+				return
+			}
+			r.ObjectVersions = append(r.ObjectVersions, oss.ObjectVersionProperties{
+				Key:          key,
+				VersionId:    o.versionId,
+				IsLatest:     o == s.objects[key],
+				LastModified: o.modified,
+				Size:         int64(len(o.data)),
+				ETag:         etagOf(o.data),
+				StorageClass: storageClassOf(o.header),
+			})
+		}
+	}
+	replyXML(w, r)
+}
+
+func (s *fakeOSS) putTagging(w http.ResponseWriter, r *http.Request, key string) {
+	o, ok := s.objects[key]
+	if !ok {
+		replyError(w, http.StatusNotFound, "NoSuchKey", "object does not exist")
+		return
+	}
+	var tagging oss.Tagging
+	if err := xml.NewDecoder(r.Body).Decode(&tagging); err != nil {
+		replyError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	o.tags = url.Values{}
+	for _, tag := range tagging.Tags {
+		o.tags.Set(tag.Key, tag.Value)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *fakeOSS) getTagging(w http.ResponseWriter, key string) {
+	o, ok := s.objects[key]
+	if !ok {
+		replyError(w, http.StatusNotFound, "NoSuchKey", "object does not exist")
+		return
+	}
+	var tagging oss.Tagging
+	for k := range o.tags {
+		tagging.Tags = append(tagging.Tags, oss.Tag{Key: k, Value: o.tags.Get(k)})
+	}
+	replyXML(w, tagging)
+}
+
+// writable checks the conditional headers of a write to key.
+func (s *fakeOSS) writable(w http.ResponseWriter, r *http.Request, key string) bool {
+	o, exists := s.objects[key]
+	if exists && r.Header.Get(oss.HTTPHeaderOssForbidOverWrite) == "true" {
+		replyError(w, http.StatusConflict, "FileAlreadyExists", "object already exists")
+		return false
+	}
+	if match := r.Header.Get(oss.HTTPHeaderIfMatch); match != "" && (!exists || match != etagOf(o.data)) {
+		replyError(w, http.StatusPreconditionFailed, "PreconditionFailed", "etag does not match")
+		return false
+	}
+	return true
+}
+
+// source finds the object of the copy source header.
+func (s *fakeOSS) source(w http.ResponseWriter, r *http.Request) (*fakeObject, bool) {
+	source, _ := url.QueryUnescape(r.Header.Get(oss.HTTPHeaderOssCopySource))
+	o, ok := s.objects[strings.TrimPrefix(source, "/"+fakeBucket+"/")]
+	if !ok {
+		replyError(w, http.StatusNotFound, "NoSuchKey", "copy source does not exist")
+	}
+	return o, ok
+}
+
+func (s *fakeOSS) store(w http.ResponseWriter, r *http.Request, key string, data []byte, appendable bool) {
+	o := &fakeObject{
+		data:       data,
+		header:     cloneHeader(r.Header),
+		tags:       url.Values{},
+		appendable: appendable,
+		modified:   time.Now(),
+	}
+	if tagging := r.Header.Get(oss.HTTPHeaderOssTagging); tagging != "" {
+		o.tags, _ = url.ParseQuery(tagging)
+	}
+	if s.versioning {
+		o.versionId = s.nextId()
+		w.Header().Set("X-Oss-Version-Id", o.versionId)
+	}
+	s.deleteObject(key)
+	s.objects[key] = o
+	w.Header().Set(oss.HTTPHeaderEtag, etagOf(data))
+	w.Header().Set(oss.HTTPHeaderOssCRC64, crc64Of(data))
+}
+
+func (s *fakeOSS) content(key string) []byte {
+	if o, ok := s.objects[key]; ok {
+		return o.data
+	}
+	return nil
+}
+
+func (s *fakeOSS) writeMeta(w http.ResponseWriter, o *fakeObject) {
+	for k, v := range o.header {
+		switch {
+		case strings.HasPrefix(k, oss.HTTPHeaderOssMetaPrefix),
+			k == oss.HTTPHeaderContentType,
+			k == oss.HTTPHeaderOssServerSideEncryption,
+			k == oss.HTTPHeaderOssServerSideEncryptionKeyID:
+			w.Header()[k] = v
+		}
+	}
+	objectType := "Normal"
+	if o.appendable {
+		objectType = "Appendable"
+	}
+	w.Header().Set("X-Oss-Object-Type", objectType)
+	w.Header().Set(oss.HTTPHeaderOssStorageClass, storageClassOf(o.header))
+	w.Header().Set(oss.HTTPHeaderEtag, etagOf(o.data))
+	w.Header().Set(oss.HTTPHeaderOssCRC64, crc64Of(o.data))
+	w.Header().Set(oss.HTTPHeaderLastModified, o.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set(oss.HTTPHeaderContentLength, strconv.Itoa(len(o.data)))
+	if len(o.tags) > 0 {
+		w.Header().Set("X-Oss-Tagging-Count", strconv.Itoa(len(o.tags)))
+	}
+	if o.versionId != "" {
+		w.Header().Set("X-Oss-Version-Id", o.versionId)
+	}
+	if o.restore != "" {
+		w.Header().Set("X-Oss-Restore", o.restore)
+	}
+}
+
+// sign computes the v1 signature the same way as the sdk.
+func sign(r *http.Request) string {
+	keys := make([]string, 0)
+	for k := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-oss-") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return strings.ToLower(keys[i]) < strings.ToLower(keys[j]) })
+	headers := make([]string, 0, len(keys))
+	for _, k := range keys {
+		headers = append(headers, strings.ToLower(k)+":"+r.Header.Get(k)+"\n")
+	}
+	params := make([]string, 0)
+	for k, v := range r.URL.Query() {
+		if !signedParams[k] {
+			continue
+		}
+		if v[0] != "" {
+			k += "=" + v[0]
+		}
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	resource := r.URL.Path
+	if strings.Count(resource, "/") == 1 {
+		resource += "/"
+	}
+	if len(params) > 0 {
+		resource += "?" + strings.Join(params, "&")
+	}
+	str := r.Method + "\n" + r.Header.Get(oss.HTTPHeaderContentMD5) + "\n" +
+		r.Header.Get(oss.HTTPHeaderContentType) + "\n" + r.Header.Get(oss.HTTPHeaderDate) + "\n" +
+		strings.Join(headers, "") + resource
+	h := hmac.New(sha1.New, []byte(fakeAccessKeySecret))
+	h.Write([]byte(str))
+	return "OSS " + fakeAccessKeyId + ":" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func replyXML(w http.ResponseWriter, v interface{}) {
+	bts, _ := xml.Marshal(v)
+	w.Header().Set(oss.HTTPHeaderContentType, "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bts)
+}
+
+type fakeError struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	RequestId string   `xml:"RequestId"`
+}
+
+func replyError(w http.ResponseWriter, status int, code, message string) {
+	bts, _ := xml.Marshal(fakeError{Code: code, Message: message,
+		RequestId: w.Header().Get(oss.HTTPHeaderOssRequestID)})
+	w.Header().Set(oss.HTTPHeaderContentType, "application/xml")
+	w.WriteHeader(status)
+	w.Write(bts)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+func storageClassOf(h http.Header) string {
+	if class := h.Get(oss.HTTPHeaderOssStorageClass); class != "" {
+		return class
+	}
+	return string(oss.StorageStandard)
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return "\"" + strings.ToUpper(hex.EncodeToString(sum[:])) + "\""
+}
+
+func contentMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func crc64Of(data []byte) string {
+	return strconv.FormatUint(crc64.Checksum(data, crc64Table), 10)
+}
+
+// storeFiles stores every key with its own name as content.
+func storeFiles(s *storage, keys ...string) error {
+	for _, key := range keys {
+		if _, err := s.StoreFile(key, []byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
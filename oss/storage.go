@@ -2,18 +2,46 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/ctrip-nephele/aliyun-oss-go-sdk/oss"
 	. "github.com/ctripcorp/nephele/storage"
+	"net/http"
+	"strconv"
+	"strings"
 )
 
+// objects larger than copyThreshold are copied part by part,
+// since CopyObject is limited to 1GB by oss.
+var copyThreshold int64 = 1 << 30
+var copyPartSize int64 = 100 << 20
+
+// deleteBatchSize is the max number of keys deleted by one DeleteObjects request.
+const deleteBatchSize = 1000
+
 type storage struct {
 	bucket *oss.Bucket
+	// reserved kvs applied to every stored object, see SSEKEY and STORAGECLASSKEY
+	defaults []KV
+	download downloader
 }
 
 func (s *storage) File(key string) File {
 	return &file{
-		bucket: s.bucket,
-		key:    key,
+		bucket:   s.bucket,
+		defaults: s.defaults,
+		key:      key,
+		download: s.download,
+	}
+}
+
+// Version returns the file of a specific version of key.
+func (s *storage) Version(key, versionId string) File {
+	return &file{
+		bucket:    s.bucket,
+		defaults:  s.defaults,
+		key:       key,
+		versionId: versionId,
+		download:  s.download,
 	}
 }
 
@@ -28,10 +56,115 @@ func (s *storage) Iterator(prefix string, lastKey string) Iterator {
 	return iter
 }
 
+// TaggedIterator iterates over the objects under prefix which have all of tags.
+// Oss can not filter by tags, so the tags of every object are fetched.
+func (s *storage) TaggedIterator(prefix string, lastKey string, tags ...KV) Iterator {
+	iter := &iterator{
+		bucket:  s.bucket,
+		prefix:  prefix,
+		lastKey: lastKey,
+		files:   make(chan *file, 100),
+	}
+	go iter.syncing()
+	return &taggedIterator{iterator: iter, tags: tags}
+}
+
+// VersionIterator iterates over every version of the objects under prefix.
+// Its LastKey contains the version id as well, and can be passed back to resume.
+func (s *storage) VersionIterator(prefix string, lastKey string) Iterator {
+	iter := &iterator{
+		bucket:   s.bucket,
+		prefix:   prefix,
+		versions: true,
+		files:    make(chan *file, 100),
+	}
+	iter.lastKey, iter.lastVersionId = splitVersion(lastKey)
+	go iter.syncing()
+	return iter
+}
+
+// StoreFile returns the id of the new version if versioning is enabled on the bucket,
+// otherwise the request id. The sdk checks the crc64 of the upload, a mismatch is ErrCorrupted.
 func (s *storage) StoreFile(key string, blob []byte, kvs ...KV) (string, error) {
-	options := make([]oss.Option, 0)
-	for _, kv := range kvs {
-		options = append(options, oss.Meta(kv[0], kv[1]))
+	var h http.Header
+	options := storeOptions(withDefaults(s.defaults, kvs))
+	options = append(options, md5Option(blob), oss.GetResponseHeader(&h))
+	rid, err := s.bucket.PutObject(key, bytes.NewReader(blob), options...)
+	if err != nil {
+		return rid, convertError(err)
+	}
+	if versionId := h.Get(VERSIONIDKEY); versionId != "" {
+		return versionId, nil
+	}
+	return rid, nil
+}
+
+// Copy copies src to dst on the server side.
+// The meta of src is preserved unless kvs have any meta, which replaces it. The reserved
+// keys of kvs and the defaults of New apply to dst as StoreFile does.
+func (s *storage) Copy(src, dst string, kvs ...KV) (string, error) {
+	h, err := s.bucket.GetObjectDetailedMeta(src)
+	if err != nil {
+		return "", convertError(err)
+	}
+	options := storeOptions(withDefaults(s.defaults, kvs))
+	replace := hasMeta(kvs)
+	size, _ := strconv.ParseInt(h.Get(oss.HTTPHeaderContentLength), 10, 64)
+	if size < copyThreshold {
+		if replace {
+			// the content type is replaced along with the meta
+			options = append(options, oss.MetadataDirective(oss.MetaReplace), oss.ContentType(h.Get(oss.HTTPHeaderContentType)))
+		}
+		_, err = s.bucket.CopyObject(src, dst, options...)
+		return "", convertError(err)
+	}
+	// a multipart copy does not inherit the meta of src
+	options = append(options, oss.ContentType(h.Get(oss.HTTPHeaderContentType)))
+	if !replace {
+		for k := range h {
+			if strings.HasPrefix(k, oss.HTTPHeaderOssMetaPrefix) {
+				options = append(options, oss.Meta(strings.TrimPrefix(k, oss.HTTPHeaderOssMetaPrefix), h.Get(k)))
+			}
+		}
+	}
+	return "", convertError(s.bucket.CopyFile(s.bucket.BucketName, src, dst, copyPartSize, options...))
+}
+
+// Rename moves src to dst by a server side copy followed by deleting src.
+func (s *storage) Rename(src, dst string, kvs ...KV) (string, error) {
+	if _, err := s.Copy(src, dst, kvs...); err != nil {
+		return "", err
+	}
+	rid, err := s.bucket.DeleteObject(src)
+	return rid, convertError(err)
+}
+
+// Symlink creates key as an alias of target, reading key returns the content of target.
+func (s *storage) Symlink(key, target string) (string, error) {
+	return "", convertError(s.bucket.PutSymlink(key, target))
+}
+
+// BatchDelete deletes keys by DeleteObjects in chunks of deleteBatchSize.
+// The returned errors are indexed as keys, nil for the deleted and the missing ones.
+func (s *storage) BatchDelete(keys []string) []error {
+	errs := make([]error, len(keys))
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		r, err := s.bucket.DeleteObjects(keys[start:end])
+		deleted := make(map[string]bool, len(r.DeletedObjects))
+		for _, key := range r.DeletedObjects {
+			deleted[key] = true
+		}
+		for i := start; i < end; i++ {
+			if err != nil {
+				errs[i] = convertError(err)
+			} else if !deleted[keys[i]] {
+				errs[i] = fmt.Errorf("object %s is not deleted", keys[i])
+			}
+		}
 	}
-	return s.bucket.PutObject(key, bytes.NewReader(blob), options...)
+	return errs
 }
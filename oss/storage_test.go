@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	. "github.com/ctripcorp/nephele/storage"
+
+	"github.com/ctrip-nephele/aliyun-oss-go-sdk/oss"
+)
+
+func Test_StoreFile(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := New(map[string]string{
+		"endpoint":        server.URL,
+		"bucketname":      fakeBucket,
+		"accessKeyId":     fakeAccessKeyId,
+		"accessKeySecret": fakeAccessKeySecret,
+		"storageClass":    "IA",
+	}).(*storage)
+	if _, e := s.StoreFile("1.txt", []byte("1")); e != nil {
+		t.Error(e)
+		return
+	}
+	if _, e := s.StoreFile("2.txt", []byte("2"), KV{STORAGECLASSKEY, "Archive"}); e != nil {
+		t.Error(e)
+		return
+	}
+	for key, class := range map[string]string{"1.txt": "IA", "2.txt": "Archive"} {
+		m, e := s.File(key).Meta()
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		if m.Fetch(STORAGECLASSKEY) != class {
+			t.Error("get storage class invalid. key:", key)
+			return
+		}
+	}
+}
+
+func Test_CopyRename(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	blob := bytes.Repeat([]byte("testest"), 50000)
+	if _, e := s.StoreFile("1.txt", blob, KV{"from", "test"}); e != nil {
+		t.Error(e)
+		return
+	}
+	//1. copy keeps meta
+	if _, e := s.Copy("1.txt", "2.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	//2. multipart copy keeps meta as well
+	copyThreshold, copyPartSize = 1, 100*1024
+	defer func() { copyThreshold, copyPartSize = 1<<30, 100<<20 }()
+	if _, e := s.Copy("1.txt", "3.txt"); e != nil {
+		t.Error(e)
+		return
+	}
+	if m, e := s.File("3.txt").Meta(); e != nil || m.Fetch("from") != "test" {
+		t.Error("multipart copy should keep meta.", e)
+		return
+	}
+	//3. rename replaces meta
+	if _, e := s.Rename("3.txt", "4.txt", KV{"from", "rename"}); e != nil {
+		t.Error(e)
+		return
+	}
+	if exists, _, _ := s.File("3.txt").Exist(); exists {
+		t.Error("renamed file should not exist.")
+		return
+	}
+	for key, from := range map[string]string{"2.txt": "test", "4.txt": "rename"} {
+		bts, _, e := s.File(key).Bytes()
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		if !bytes.Equal(bts, blob) {
+			t.Error("get content invalid. key:", key)
+			return
+		}
+		m, e := s.File(key).Meta()
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		if m.Fetch("from") != from {
+			t.Error("get meta invalid. key:", key)
+			return
+		}
+	}
+	//4. errors of the copy and the delete are converted
+	copyThreshold, copyPartSize = 1<<30, 100<<20
+	server.inject(fault{}, fault{status: 404})
+	if _, e := s.Copy("2.txt", "5.txt"); !errors.Is(e, ErrNotFound) {
+		t.Error("copy error should be converted. e:", e)
+		return
+	}
+	server.inject(fault{}, fault{}, fault{status: 404})
+	if _, e := s.Rename("2.txt", "5.txt"); !errors.Is(e, ErrNotFound) {
+		t.Error("rename error should be converted. e:", e)
+		return
+	}
+	//5. reserved keys and the defaults apply to dst instead of becoming meta
+	s.defaults = []KV{{SSEKEY, "AES256"}}
+	if _, e := s.Copy("2.txt", "6.txt", KV{STORAGECLASSKEY, "IA"}); e != nil {
+		t.Error(e)
+		return
+	}
+	if _, e := s.Copy("2.txt", "7.txt", KV{"from", "copy"}); e != nil {
+		t.Error(e)
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	h6, h7 := server.objects["6.txt"].header, server.objects["7.txt"].header
+	if h6.Get(oss.HTTPHeaderOssMetaPrefix+"From") != "test" || storageClassOf(h6) != "IA" || h6.Get(oss.HTTPHeaderOssMetaPrefix+STORAGECLASSKEY) != "" {
+		t.Error("copy with a storage class invalid.", h6)
+		return
+	}
+	if h7.Get(oss.HTTPHeaderOssMetaPrefix+"From") != "copy" || h7.Get(oss.HTTPHeaderContentType) != server.objects["2.txt"].header.Get(oss.HTTPHeaderContentType) {
+		t.Error("copy replacing meta should keep the content type.", h7)
+		return
+	}
+	if h6.Get(SSEKEY) != "AES256" || h7.Get(SSEKEY) != "AES256" {
+		t.Error("copy should apply the defaults.")
+	}
+}
+
+func Test_BatchDelete(t *testing.T) {
+	server := newFakeOSS()
+	defer server.Close()
+	s := server.storage()
+	keys := make([]string, 0, deleteBatchSize+1)
+	for i := 0; i < cap(keys); i++ {
+		keys = append(keys, string(rune('a'+i%26))+string(rune('a'+i/26)))
+	}
+	if e := storeFiles(s, keys...); e != nil {
+		t.Error(e)
+		return
+	}
+	//a missing key is ignored
+	keys = append(keys, "missing")
+	server.inject(fault{status: 412})
+	if errs := s.BatchDelete(keys); errs[0] != ErrPreconditionFailed || errs[len(errs)-1] != nil {
+		t.Error("batch error should be converted.", errs[0], errs[len(errs)-1])
+		return
+	}
+	for i, e := range s.BatchDelete(keys) {
+		if e != nil {
+			t.Error("delete failed. key:", keys[i], "e:", e)
+			return
+		}
+	}
+	if len(server.objects) != 0 {
+		t.Error("objects are not deleted.")
+		return
+	}
+}